@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Keeps the registered accounts and which browsers are signed in to them
+var accounts = NewAccounts()
+
+// Shortest password we'll take
+const minPasswordLength = 8
+
+// Reasons a guest can't register or sign in
+var (
+	ErrBadUsername   = errors.New("Usernames need to be 3 to 20 letters, numbers or underscores.")
+	ErrShortPassword = errors.New("Passwords need to be at least 8 characters.")
+	ErrUsernameTaken = errors.New("Somebody already has that username.")
+	ErrWrongLogin    = errors.New("That username and password don't match.")
+)
+
+//***********************************************************************************************
+//
+// External
+//
+//***********************************************************************************************
+
+// NewAccounts builds an empty set of accounts that only lives in memory
+// until it's opened on a file
+func NewAccounts() *Accounts {
+
+	return &Accounts{
+		byName:   make(map[string]*Account),
+		signedIn: make(map[string]string),
+	}
+}
+
+// Open loads the accounts already in the file
+// and saves every change back to it from then on
+func (a *Accounts) Open(path string) error {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.path = path
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	saved := accountsFile{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+
+	for _, account := range saved.Accounts {
+		a.byName[account.key()] = account
+	}
+	for session, name := range saved.SignedIn {
+		a.signedIn[session] = name
+	}
+	return nil
+}
+
+// Register makes a new account and signs the browser in to it
+func (a *Accounts) Register(username string, password string, uid string) error {
+
+	username = strings.TrimSpace(username)
+	if !validUsername(username) {
+		return ErrBadUsername
+	}
+	if len(password) < minPasswordLength {
+		return ErrShortPassword
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	account := &Account{
+		Username: username,
+		Hash:     hash,
+		Created:  time.Now(),
+	}
+	if _, taken := a.byName[account.key()]; taken {
+		return ErrUsernameTaken
+	}
+
+	a.byName[account.key()] = account
+	a.signIn(account, uid)
+
+	return a.save()
+}
+
+// SignIn checks the password and signs the browser in to the account
+func (a *Accounts) SignIn(username string, password string, uid string) error {
+
+	a.mu.RLock()
+	account, ok := a.byName[strings.ToLower(strings.TrimSpace(username))]
+	a.mu.RUnlock()
+
+	if !ok {
+		// still spend the time hashing so nobody can tell
+		// which usernames exist by how long this takes
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return ErrWrongLogin
+	}
+
+	if bcrypt.CompareHashAndPassword(account.Hash, []byte(password)) != nil {
+		return ErrWrongLogin
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.signIn(account, uid)
+	return a.save()
+}
+
+// SignOut forgets the browser was signed in
+// the games it already played still count towards the account
+func (a *Accounts) SignOut(uid string) error {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.signedIn, PlayerID(uid))
+	return a.save()
+}
+
+// SignedIn finds the account the browser is signed in to
+func (a *Accounts) SignedIn(uid string) (string, bool) {
+
+	return a.PlayerAccount(PlayerID(uid))
+}
+
+// PlayerAccount finds the account a player is signed in to
+// going by the hashed id the game knows them by
+func (a *Accounts) PlayerAccount(id string) (string, bool) {
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	name, ok := a.signedIn[id]
+	if !ok {
+		return "", false
+	}
+	return a.byName[name].Username, true
+}
+
+// Leaderboard adds up every account's games from the history
+// in a room if one is given, best score first
+// each game counts for whoever was signed in when it finished
+func (a *Accounts) Leaderboard(room string) []Stats {
+
+	a.mu.RLock()
+	names := make(map[string]string)
+	for key, account := range a.byName {
+		names[key] = account.Username
+	}
+	a.mu.RUnlock()
+
+	totals := make(map[string]*Stats)
+	total := func(account string) (*Stats, bool) {
+
+		name, ok := names[strings.ToLower(account)]
+		if !ok {
+			return nil, false
+		}
+		if _, ok := totals[name]; !ok {
+			totals[name] = &Stats{Username: name}
+		}
+		return totals[name], true
+	}
+
+	for _, match := range history.Find(room, "") {
+
+		// work out whose seats are whose in this match
+		owners := make(map[string]*Stats)
+		for _, p := range match.Players {
+			if stats, ok := total(p.Account); ok {
+				owners[p.ID] = stats
+				stats.Games++
+				stats.Score += p.Score
+			}
+		}
+
+		// presenting time runs from the last noun to this one
+		last := match.StartedAt
+		for _, played := range match.Nouns {
+
+			if stats, ok := owners[played.Guesser]; ok {
+				stats.NounsGuessed++
+			}
+			if stats, ok := owners[played.Presenter]; ok {
+				stats.NounsPresented++
+				stats.PresentingTime += played.GuessedAt.Sub(last)
+			}
+			last = played.GuessedAt
+		}
+	}
+
+	board := []Stats{}
+	for _, stats := range totals {
+
+		if minutes := stats.PresentingTime.Minutes(); minutes > 0 {
+			stats.Efficiency = float64(stats.NounsPresented) / minutes
+		}
+		board = append(board, *stats)
+	}
+
+	sort.Slice(board, func(i, j int) bool {
+		if board[i].Score != board[j].Score {
+			return board[i].Score > board[j].Score
+		}
+		return board[i].Username < board[j].Username
+	})
+
+	return board
+}
+
+// StatsFor gets the lifetime stats for the account
+func (a *Accounts) StatsFor(username string) Stats {
+
+	for _, stats := range a.Leaderboard("") {
+		if stats.Username == username {
+			return stats
+		}
+	}
+	return Stats{Username: username}
+}
+
+//***********************************************************************************************
+//
+// Internal
+//
+//***********************************************************************************************
+
+// A hash to check against when there's no account
+// so a missing username takes as long as a wrong password
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("nobody has this password"), bcrypt.DefaultCost)
+
+// signIn links the browser to the account until it signs out
+// the lock must already be held
+func (a *Accounts) signIn(account *Account, uid string) {
+
+	a.signedIn[PlayerID(uid)] = account.key()
+}
+
+// save writes the accounts out if there's a file to write to
+// the lock must already be held
+func (a *Accounts) save() error {
+
+	if a.path == "" {
+		return nil
+	}
+
+	saved := accountsFile{SignedIn: a.signedIn}
+	for _, account := range a.byName {
+		saved.Accounts = append(saved.Accounts, account)
+	}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return writeFile(a.path, data)
+}
+
+// key is how the account is looked up, usernames aren't case sensitive
+func (account *Account) key() string {
+
+	return strings.ToLower(account.Username)
+}
+
+// validUsername checks the username is something we can show
+func validUsername(username string) bool {
+
+	if len(username) < 3 || len(username) > 20 {
+		return false
+	}
+
+	for _, r := range username {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+//***********************************************************************************************
+//
+// Structs
+//
+//***********************************************************************************************
+
+// Accounts is everyone who has registered
+// along with which browsers are signed in
+type Accounts struct {
+	mu       sync.RWMutex
+	byName   map[string]*Account
+	signedIn map[string]string
+	path     string
+}
+
+// Account is a registered player
+type Account struct {
+	Username string    `json:"username"`
+	Hash     []byte    `json:"hash"`
+	Created  time.Time `json:"created"`
+}
+
+// Stats are how a player has done over every game they've played
+// efficiency is how many nouns they get across a minute when presenting
+type Stats struct {
+	Username       string        `json:"username"`
+	Games          int           `json:"games"`
+	Score          int           `json:"score"`
+	NounsGuessed   int           `json:"nounsGuessed"`
+	NounsPresented int           `json:"nounsPresented"`
+	PresentingTime time.Duration `json:"presentingTime"`
+	Efficiency     float64       `json:"efficiency"`
+}
+
+// accountsFile is how the accounts are kept on disk
+// browsers are kept by their hashed uid
+type accountsFile struct {
+	Accounts []*Account        `json:"accounts"`
+	SignedIn map[string]string `json:"signedIn"`
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRegisterAndSignIn(t *testing.T) {
+
+	a := NewAccounts()
+
+	if err := a.Register("x", "password123", "uid-1"); err != ErrBadUsername {
+		t.Error("Expected", ErrBadUsername, "got", err)
+	}
+	if err := a.Register("has space", "password123", "uid-1"); err != ErrBadUsername {
+		t.Error("Expected", ErrBadUsername, "got", err)
+	}
+	if err := a.Register("ann", "short", "uid-1"); err != ErrShortPassword {
+		t.Error("Expected", ErrShortPassword, "got", err)
+	}
+
+	if err := a.Register("Ann", "password123", "uid-1"); err != nil {
+		t.Fatal("Expected", nil, "got", err)
+	}
+	if name, ok := a.SignedIn("uid-1"); !ok || name != "Ann" {
+		t.Error("Expected", "Ann", "got", name, ok)
+	}
+
+	// usernames aren't case sensitive
+	if err := a.Register("ANN", "password123", "uid-2"); err != ErrUsernameTaken {
+		t.Error("Expected", ErrUsernameTaken, "got", err)
+	}
+
+	if err := a.SignOut("uid-1"); err != nil {
+		t.Fatal("Expected", nil, "got", err)
+	}
+	if _, ok := a.SignedIn("uid-1"); ok {
+		t.Error("Expected", "to be signed out", "got", "still signed in")
+	}
+
+	if err := a.SignIn("ann", "wrong password", "uid-2"); err != ErrWrongLogin {
+		t.Error("Expected", ErrWrongLogin, "got", err)
+	}
+	if err := a.SignIn("nobody", "password123", "uid-2"); err != ErrWrongLogin {
+		t.Error("Expected", ErrWrongLogin, "got", err)
+	}
+	if err := a.SignIn("aNn", "password123", "uid-2"); err != nil {
+		t.Error("Expected", nil, "got", err)
+	}
+	if name, ok := a.SignedIn("uid-2"); !ok || name != "Ann" {
+		t.Error("Expected", "Ann", "got", name, ok)
+	}
+}
+
+func TestAccountsAreSaved(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "accounts.json")
+
+	a := NewAccounts()
+	if err := a.Open(path); err != nil {
+		t.Fatal("Expected", nil, "got", err)
+	}
+	if err := a.Register("bob", "password123", "uid-1"); err != nil {
+		t.Fatal("Expected", nil, "got", err)
+	}
+
+	reopened := NewAccounts()
+	if err := reopened.Open(path); err != nil {
+		t.Fatal("Expected", nil, "got", err)
+	}
+	if name, ok := reopened.SignedIn("uid-1"); !ok || name != "bob" {
+		t.Error("Expected", "bob", "got", name, ok)
+	}
+	if err := reopened.SignIn("bob", "password123", "uid-2"); err != nil {
+		t.Error("Expected", nil, "got", err)
+	}
+}
+
+func TestLeaderboard(t *testing.T) {
+
+	signedIn := accounts
+	accounts = NewAccounts()
+	defer func() { accounts = signedIn }()
+
+	room := buildRoom(newCode(), false)
+	other := buildRoom(newCode(), false)
+
+	// usernames only have to be unique to the accounts but the history is shared
+	ann, bob := "ann_"+room.ID, "bob_"+room.ID
+
+	if err := accounts.Register(ann, "password123", room.ID+"-ann"); err != nil {
+		t.Fatal("Expected", nil, "got", err)
+	}
+	if err := accounts.Register(bob, "password123", room.ID+"-bob"); err != nil {
+		t.Fatal("Expected", nil, "got", err)
+	}
+
+	// ann plays the other game from a different browser
+	if err := accounts.SignIn(ann, "password123", other.ID+"-ann"); err != nil {
+		t.Fatal("Expected", nil, "got", err)
+	}
+
+	playIn(t, room, 2, 0)
+	playIn(t, other, 1, 0)
+
+	board := accounts.Leaderboard(room.ID)
+	if len(board) != 2 {
+		t.Fatal("Expected", 2, "got", len(board))
+	}
+
+	// every noun is guessed by one of them and presented by the other
+	// so the two of them share the 12 nouns in the game both ways
+	guessed, presented, score := 0, 0, 0
+	for _, stats := range board {
+
+		if stats.Games != 1 {
+			t.Error("Expected", 1, "got", stats.Games)
+		}
+		if stats.NounsPresented > 0 && stats.Efficiency <= 0 {
+			t.Error("Expected", "an efficiency", "got", stats.Efficiency)
+		}
+		guessed += stats.NounsGuessed
+		presented += stats.NounsPresented
+		score += stats.Score
+	}
+	if guessed != 12 || presented != 12 || score != 24 {
+		t.Error("Expected", 12, 12, 24, "got", guessed, presented, score)
+	}
+	if board[0].Score < board[1].Score {
+		t.Error("Expected", "the best score first", "got", board[0].Score, board[1].Score)
+	}
+
+	// across every room ann has both games
+	if stats := accounts.StatsFor(ann); stats.Games != 2 {
+		t.Error("Expected", 2, "got", stats.Games)
+	}
+	if stats := accounts.StatsFor(bob); stats.Games != 1 {
+		t.Error("Expected", 1, "got", stats.Games)
+	}
+}
+
+func TestLeaderboardCreditsWhoeverWasSignedIn(t *testing.T) {
+
+	signedIn := accounts
+	accounts = NewAccounts()
+	defer func() { accounts = signedIn }()
+
+	first := buildRoom(newCode(), false)
+	second := buildRoom(newCode(), false)
+	third := buildRoom(newCode(), false)
+
+	// everyone plays from the same browser with the same uids
+	second.ID, third.ID = first.ID, first.ID
+	alice, bob := "alice_"+first.ID, "bob_"+first.ID
+
+	if err := accounts.Register(alice, "password123", first.ID+"-ann"); err != nil {
+		t.Fatal("Expected", nil, "got", err)
+	}
+	playIn(t, first, 1, 0)
+
+	// alice signs out and plays a game as a guest
+	if err := accounts.SignOut(first.ID + "-ann"); err != nil {
+		t.Fatal("Expected", nil, "got", err)
+	}
+	playIn(t, second, 1, 0)
+
+	// then someone else registers on the same browser
+	if err := accounts.Register(bob, "password123", first.ID+"-ann"); err != nil {
+		t.Fatal("Expected", nil, "got", err)
+	}
+	playIn(t, third, 1, 0)
+
+	for i := 0; i < 20; i++ {
+
+		if stats := accounts.StatsFor(alice); stats.Games != 1 {
+			t.Fatal("Expected", 1, "got", stats.Games)
+		}
+		if stats := accounts.StatsFor(bob); stats.Games != 1 {
+			t.Fatal("Expected", 1, "got", stats.Games)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Where rooms are registered and messages pass between instances
+// memory only works for a single instance, redis lets several share rooms
+var backend Backend = NewMemoryBackend()
+
+// Tells this instance apart from the others sharing the backend
+var instanceID = uuid.New().String()
+
+// Everything kept in the backend is under this prefix
+// so nouns can share a redis with other things
+const backendPrefix = "nouns:"
+
+// How many messages a subscription holds before the backend starts dropping them
+const subscriptionBuffer = 256
+
+//***********************************************************************************************
+//
+// External
+//
+//***********************************************************************************************
+
+// Backend is somewhere the instances can keep shared keys and pass messages
+// a ttl of zero keeps the key until it's removed
+type Backend interface {
+
+	// Claim sets the key only if nobody else has it
+	Claim(key string, value string, ttl time.Duration) (bool, error)
+
+	// Refresh pushes out the key's expiry as long as it still holds the value
+	Refresh(key string, value string, ttl time.Duration) (bool, error)
+
+	// Release removes the key as long as it still holds the value
+	Release(key string, value string) error
+
+	Set(key string, value string, ttl time.Duration) error
+	Get(key string) (string, bool, error)
+	Delete(key string) error
+
+	// Scan finds every key under the prefix along with its value
+	Scan(prefix string) (map[string]string, error)
+
+	// Publish sends the message to everyone subscribed to the channel
+	// including this instance, channels go under the prefix the same as keys
+	Publish(channel string, message []byte) error
+	Subscribe(channel string) (Subscription, error)
+
+	Close() error
+}
+
+// Subscription hands over the messages published to a channel
+// until it's closed
+type Subscription interface {
+	Messages() <-chan []byte
+	Close() error
+}
+
+// NewMemoryBackend builds a backend that lives in this instance's memory
+func NewMemoryBackend() *MemoryBackend {
+
+	return &MemoryBackend{
+		keys:        make(map[string]memoryKey),
+		subscribers: make(map[string]map[*memorySubscription]bool),
+	}
+}
+
+// Claim sets the key only if nobody else has it
+func (m *MemoryBackend) Claim(key string, value string, ttl time.Duration) (bool, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.get(key); ok {
+		return false, nil
+	}
+
+	m.keys[key] = newMemoryKey(value, ttl)
+	return true, nil
+}
+
+// Refresh pushes out the key's expiry as long as it still holds the value
+func (m *MemoryBackend) Refresh(key string, value string, ttl time.Duration) (bool, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if held, ok := m.get(key); !ok || held != value {
+		return false, nil
+	}
+
+	m.keys[key] = newMemoryKey(value, ttl)
+	return true, nil
+}
+
+// Release removes the key as long as it still holds the value
+func (m *MemoryBackend) Release(key string, value string) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if held, ok := m.get(key); ok && held == value {
+		delete(m.keys, key)
+	}
+	return nil
+}
+
+// Set puts the value in the key whether or not it's there already
+func (m *MemoryBackend) Set(key string, value string, ttl time.Duration) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.keys[key] = newMemoryKey(value, ttl)
+	return nil
+}
+
+// Get finds the value in the key if it hasn't expired
+func (m *MemoryBackend) Get(key string) (string, bool, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	value, ok := m.get(key)
+	return value, ok, nil
+}
+
+// Delete removes the key
+func (m *MemoryBackend) Delete(key string) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.keys, key)
+	return nil
+}
+
+// Scan finds every key under the prefix that hasn't expired
+// any that have are cleared out along the way
+func (m *MemoryBackend) Scan(prefix string) (map[string]string, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	found := make(map[string]string)
+	for key := range m.keys {
+
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if value, ok := m.get(key); ok {
+			found[key] = value
+		}
+	}
+	return found, nil
+}
+
+// Publish hands the message to every subscription on the channel
+// a subscription that has fallen too far behind misses it
+func (m *MemoryBackend) Publish(channel string, message []byte) error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for sub := range m.subscribers[channel] {
+
+		select {
+		case sub.messages <- message:
+		default:
+			log.Println("Subscription to", channel, "is full, dropping a message")
+		}
+	}
+	return nil
+}
+
+// Subscribe starts listening to the channel
+func (m *MemoryBackend) Subscribe(channel string) (Subscription, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sub := &memorySubscription{
+		backend:  m,
+		channel:  channel,
+		messages: make(chan []byte, subscriptionBuffer),
+	}
+
+	if m.subscribers[channel] == nil {
+		m.subscribers[channel] = make(map[*memorySubscription]bool)
+	}
+	m.subscribers[channel][sub] = true
+
+	return sub, nil
+}
+
+// Close ends every subscription since nothing more will be published
+// there's nothing to disconnect from
+func (m *MemoryBackend) Close() error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for channel, subs := range m.subscribers {
+		for sub := range subs {
+			close(sub.messages)
+		}
+		delete(m.subscribers, channel)
+	}
+	return nil
+}
+
+// Messages hands over the messages published to the channel
+func (sub *memorySubscription) Messages() <-chan []byte {
+
+	return sub.messages
+}
+
+// Close stops listening to the channel
+// it is safe to call more than once
+func (sub *memorySubscription) Close() error {
+
+	sub.backend.mu.Lock()
+	defer sub.backend.mu.Unlock()
+
+	subs := sub.backend.subscribers[sub.channel]
+	if !subs[sub] {
+		return nil
+	}
+
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(sub.backend.subscribers, sub.channel)
+	}
+	close(sub.messages)
+
+	return nil
+}
+
+//***********************************************************************************************
+//
+// Internal
+//
+//***********************************************************************************************
+
+// get finds the value in the key clearing it out if it has expired
+// the lock must already be held
+func (m *MemoryBackend) get(key string) (string, bool) {
+
+	held, ok := m.keys[key]
+	if !ok {
+		return "", false
+	}
+
+	if !held.expires.IsZero() && time.Now().After(held.expires) {
+		delete(m.keys, key)
+		return "", false
+	}
+	return held.value, true
+}
+
+// newMemoryKey works out when the key expires
+func newMemoryKey(value string, ttl time.Duration) memoryKey {
+
+	held := memoryKey{value: value}
+	if ttl > 0 {
+		held.expires = time.Now().Add(ttl)
+	}
+	return held
+}
+
+//***********************************************************************************************
+//
+// Structs
+//
+//***********************************************************************************************
+
+// MemoryBackend keeps the keys and channels in memory
+// and is safe to use from multiple routines
+type MemoryBackend struct {
+	mu          sync.Mutex
+	keys        map[string]memoryKey
+	subscribers map[string]map[*memorySubscription]bool
+}
+
+// memoryKey is a value and when it stops counting
+type memoryKey struct {
+	value   string
+	expires time.Time
+}
+
+// memorySubscription is someone listening to a channel in memory
+type memorySubscription struct {
+	backend  *MemoryBackend
+	channel  string
+	messages chan []byte
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// testBackend runs the same checks against any backend
+// wait lets the backend's clock move on far enough for keys to expire
+func testBackend(t *testing.T, b Backend, wait func(time.Duration)) {
+
+	ttl := time.Millisecond * 50
+
+	if claimed, err := b.Claim("test:claim", "one", ttl); err != nil || !claimed {
+		t.Error("Expected", "to claim the key", "got", claimed, err)
+	}
+	if claimed, _ := b.Claim("test:claim", "two", ttl); claimed {
+		t.Error("Expected", "the key to be taken", "got", "claimed again")
+	}
+
+	// only whoever holds the key can refresh or release it
+	if held, err := b.Refresh("test:claim", "two", ttl); err != nil || held {
+		t.Error("Expected", "no refresh for the wrong value", "got", held, err)
+	}
+	if held, err := b.Refresh("test:claim", "one", ttl); err != nil || !held {
+		t.Error("Expected", "a refresh", "got", held, err)
+	}
+	b.Release("test:claim", "two")
+	if value, ok, _ := b.Get("test:claim"); !ok || value != "one" {
+		t.Error("Expected", "one", "got", value, ok)
+	}
+	b.Release("test:claim", "one")
+	if _, ok, _ := b.Get("test:claim"); ok {
+		t.Error("Expected", "the key to be released", "got", "it still there")
+	}
+
+	// keys run out unless they're kept for good
+	b.Set("test:short", "gone soon", ttl)
+	b.Set("test:long", "here to stay", 0)
+	b.Set("test:scan:short", "gone soon", ttl)
+	b.Set("test:scan:long", "here to stay", 0)
+	wait(ttl * 2)
+
+	// scans only find what's under the prefix and still there
+	found, err := b.Scan("test:scan:")
+	if err != nil || len(found) != 1 || found["test:scan:long"] != "here to stay" {
+		t.Error("Expected", "just test:scan:long", "got", found, err)
+	}
+	b.Delete("test:scan:long")
+
+	if _, ok, _ := b.Get("test:short"); ok {
+		t.Error("Expected", "the key to expire", "got", "it still there")
+	}
+	if value, ok, _ := b.Get("test:long"); !ok || value != "here to stay" {
+		t.Error("Expected", "here to stay", "got", value, ok)
+	}
+	if claimed, _ := b.Claim("test:short", "again", ttl); !claimed {
+		t.Error("Expected", "an expired key to be claimable", "got", claimed)
+	}
+
+	b.Delete("test:long")
+	if _, ok, _ := b.Get("test:long"); ok {
+		t.Error("Expected", "the key to be deleted", "got", "it still there")
+	}
+
+	// every subscriber gets every message in order
+	channel := backendPrefix + "test:channel"
+	first, err := b.Subscribe(channel)
+	if err != nil {
+		t.Fatal("Error subscribing", err)
+	}
+	second, err := b.Subscribe(channel)
+	if err != nil {
+		t.Fatal("Error subscribing", err)
+	}
+
+	for _, message := range []string{"a", "b", "c"} {
+		if err := b.Publish(channel, []byte(message)); err != nil {
+			t.Fatal("Error publishing", err)
+		}
+	}
+
+	for _, sub := range []Subscription{first, second} {
+		for _, expected := range []string{"a", "b", "c"} {
+
+			select {
+			case got := <-sub.Messages():
+				if string(got) != expected {
+					t.Error("Expected", expected, "got", string(got))
+				}
+			case <-time.After(time.Second * 5):
+				t.Fatal("Expected", expected, "got", "nothing")
+			}
+		}
+	}
+
+	// a closed subscription stops getting messages
+	first.Close()
+	first.Close()
+	b.Publish(channel, []byte("d"))
+
+	select {
+	case got := <-second.Messages():
+		if string(got) != "d" {
+			t.Error("Expected", "d", "got", string(got))
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected", "d", "got", "nothing")
+	}
+
+	for got := range first.Messages() {
+		t.Error("Expected", "nothing after closing", "got", string(got))
+	}
+	second.Close()
+}
+
+func TestMemoryBackend(t *testing.T) {
+
+	testBackend(t, NewMemoryBackend(), time.Sleep)
+}
+
+func TestRedisBackend(t *testing.T) {
+
+	server := miniredis.RunT(t)
+
+	b, err := NewRedisBackend(server.Addr())
+	if err != nil {
+		t.Fatal("Error connecting to redis", err)
+	}
+	defer b.Close()
+
+	testBackend(t, b, server.FastForward)
+
+	// the rooms all listen through the one connection
+	before := server.CurrentConnectionCount()
+	for i := 0; i < 20; i++ {
+		sub, err := b.Subscribe(backendPrefix + "test:room:" + strconv.Itoa(i))
+		if err != nil {
+			t.Fatal("Error subscribing", err)
+		}
+		defer sub.Close()
+	}
+	if after := server.CurrentConnectionCount(); after != before {
+		t.Error("Expected", before, "connections got", after)
+	}
+
+	if _, err := NewRedisBackend("127.0.0.1:1"); err == nil {
+		t.Error("Expected", "an error connecting to nothing", "got", nil)
+	}
+}
+
+func TestSharedCookieKeys(t *testing.T) {
+
+	b := NewMemoryBackend()
+
+	first, second := NewKeyring(), NewKeyring()
+	if err := first.Share(b); err != nil {
+		t.Fatal("Expected", nil, "got", err)
+	}
+	if err := second.Share(b); err != nil {
+		t.Fatal("Expected", nil, "got", err)
+	}
+
+	// either instance can check the other's cookies
+	signed := first.sign("uid", "shared-uid")
+	if value, err := second.verify("uid", signed); err != nil || value != "shared-uid" {
+		t.Error("Expected", "shared-uid", "got", value, err)
+	}
+
+	// only one of them rotates each time around
+	if err := first.rotate(time.Hour); err != nil {
+		t.Fatal("Expected", nil, "got", err)
+	}
+	if err := second.rotate(time.Hour); err != nil {
+		t.Fatal("Expected", nil, "got", err)
+	}
+	if len(second.keys) != 2 {
+		t.Error("Expected", 2, "got", len(second.keys))
+	}
+
+	// cookies signed after the rotation check out everywhere
+	signed = first.sign("uid", "rotated-uid")
+	if value, err := second.verify("uid", signed); err != nil || value != "rotated-uid" {
+		t.Error("Expected", "rotated-uid", "got", value, err)
+	}
+}
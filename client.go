@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -11,8 +12,7 @@ import (
 )
 
 // Keeps track of all the open sessions
-var sessions = make(map[string]*Session)
-var lastClean = time.Now()
+var sessions = NewSessionStore()
 
 //***********************************************************************************************
 //
@@ -23,20 +23,43 @@ var lastClean = time.Now()
 // NewClient checks the session id cookie to see if the client
 // already has an open session and either connects them back to
 // their open session or creates a new one
-func NewClient(uid string, name string, room *Room, conn *websocket.Conn) {
+// spectators get to watch but are never seated as players
+func NewClient(uid string, name string, spectator bool, room *Room, conn *websocket.Conn) {
 
 	client := &Client{
-		room:   room,
-		conn:   conn,
-		UserID: uid,
-		Name:   name,
-		send:   make(chan interface{}),
+		room:      room,
+		conn:      conn,
+		UserID:    uid,
+		ID:        PlayerID(uid),
+		Name:      name,
+		Spectator: spectator,
+		send:      NewOutbox(*sendQueue, overflowPolicy),
+		admit:     make(chan error, 1),
 	}
 
-	sessions[uid] = &Session{client, time.Now()}
+	// check into the room unless it has already closed
+	select {
 
-	// check into the room
-	room.checkin <- client
+	case room.checkin <- client:
+
+	case <-room.done:
+
+		log.Println("Room", room.ID, "closed before the client could check in")
+		conn.Close()
+		return
+	}
+
+	// the room might not have space for them
+	if err := <-client.admit; err != nil {
+
+		conn.WriteMessage(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error()))
+
+		conn.Close()
+
+		return
+	}
 
 	// start listening for messages
 	go reader(client)
@@ -46,28 +69,11 @@ func NewClient(uid string, name string, room *Room, conn *websocket.Conn) {
 
 // AddCookies gets the uuid session id if it exists in the cookies
 // else it will add a new session id along with the users chosen guestname
-func AddCookies(res http.ResponseWriter, req *http.Request) {
+// the session id is handed back either way
+func AddCookies(res http.ResponseWriter, req *http.Request) string {
 	addGuestName(res, req)
-	addUserID(res, req)
-}
-
-// ActiveSession checks to see if the vistor has a session id or not
-func ActiveSession(res http.ResponseWriter, req *http.Request) (string, bool) {
-	userID, err := req.Cookie("uid")
-	if err != nil {
-		log.Println("Error reading cookie for uid", err)
-	}
-	return userID.Value, err == nil
-}
-
-// GetGuestName gets the guestname for the guest
-func GetGuestName(res http.ResponseWriter, req *http.Request) string {
-	cookie, err := req.Cookie("guestname")
-	if err != nil {
-		log.Println("Error reading cookie for guestname", err)
-		return "annonymous"
-	}
-	return cookie.Value
+	addSpectator(res, req)
+	return addUserID(res, req)
 }
 
 //***********************************************************************************************
@@ -82,10 +88,17 @@ func reader(client *Client) {
 
 	// if the reader returns then we checkout
 	// the client since theyre no longer connected
-	defer func() {
-		client.conn.Close() // kill the socket
-		client.room.checkout <- client
-	}()
+	defer client.close()
+
+	// anything quiet for longer than the pong wait is considered
+	// dead, each pong from the browser buys the client more time
+	wait := *pongWait
+	client.conn.SetReadLimit(*maxMessageSize)
+	client.conn.SetReadDeadline(time.Now().Add(wait))
+	client.conn.SetPongHandler(func(string) error {
+		return client.conn.SetReadDeadline(time.Now().Add(wait))
+	})
+
 	for {
 
 		// unmarshal to the envelope first
@@ -100,6 +113,13 @@ func reader(client *Client) {
 			return
 		}
 		log.Printf("Received %v type payload..", env.Type)
+		sessions.Touch(client.UserID)
+
+		// spectators can watch but not play
+		if client.Spectator {
+			log.Println("Ignoring", env.Type, "from a spectator")
+			continue
+		}
 
 		switch env.Type {
 
@@ -114,7 +134,7 @@ func reader(client *Client) {
 			err := json.Unmarshal(body, &submission)
 			if err != nil {
 				log.Println("Error unmarshalling json for submission:", err)
-				return
+				continue
 			}
 
 			person := Noun{
@@ -130,7 +150,10 @@ func reader(client *Client) {
 				Text: submission.Thing,
 			}
 
-			client.room.CurrGame.Nouns.Add(person, place, thing)
+			client.do(Submission{
+				Nouns:  []Noun{person, place, thing},
+				client: client,
+			})
 
 		case "message":
 
@@ -140,33 +163,37 @@ func reader(client *Client) {
 
 			err := json.Unmarshal(body, &message)
 			if err != nil {
-				log.Panicln("Error unmarshalling json for message:", err)
-				return
+				log.Println("Error unmarshalling json for message:", err)
+				continue
 			}
 
-			if client.room.CurrGame.Presenter.UserID == client.UserID {
+			client.do(Message{
+				Text:   message.Message,
+				client: client,
+			})
 
-				hint := message.Message
-				client.room.publish <- &Hint{
-					Text:   hint,
-					Noun:   *client.room.CurrGame.CurrentNoun,
-					client: client,
-				}
+		case "start":
 
-			} else {
+			client.do(Start{})
 
-				guess := &Guess{
-					Text:   message.Message,
-					Player: client.Name,
-					client: client,
-				}
+		case "pass":
 
-				client.room.CurrGame.DoGuess(guess)
-			}
+			client.do(Pass{client: client})
 
-		case "start":
+		case "settings":
 
-			client.room.CurrGame.Start()
+			settings := RoomSettings{}
+
+			err := json.Unmarshal(body, &settings)
+			if err != nil {
+				log.Println("Error unmarshalling json for settings:", err)
+				continue
+			}
+
+			client.do(ChangeSettings{
+				Settings: settings,
+				client:   client,
+			})
 		}
 	}
 }
@@ -175,69 +202,145 @@ func reader(client *Client) {
 // and relay them to this client
 func writer(client *Client) {
 
-	// if the reader returns then we checkout
+	// keep pinging the browser so we notice when it goes away
+	wait := *writeWait
+	ticker := time.NewTicker(*pingPeriod)
+
+	// if the writer returns then we checkout
 	// the client since theyre no longer connected
 	defer func() {
-		client.conn.Close() // kill the socket
-		client.room.checkout <- client
+		ticker.Stop()
+		client.close()
 	}()
 	for {
 
 		select {
 
-		case message, ok := <-client.send:
+		case <-client.send.Ready():
 
-			log.Printf("Message type %T:", message)
+			messages, open := client.send.Drain()
 
-			if !ok {
-				log.Println("Client channel closed:", ok)
-				return
-			}
+			for _, message := range messages {
 
-			env := Envelope{}
+				log.Printf("Message type %T:", message)
 
-			switch message.(type) {
-			case *Noun:
-				log.Println("Sending a Noun")
-				env = Envelope{
-					Type: "noun",
-					Body: message,
-				}
-			case *Guess:
-				log.Println("Sending a Guess")
-				env = Envelope{
-					Type: "guess",
-					Body: message,
-				}
-			case *Hint:
-				log.Println("Sending a Hint")
-				env = Envelope{
-					Type: "hint",
-					Body: message,
-				}
-			case Start:
-				log.Println("Sending a start message")
-				env = Envelope{
-					Type: "start",
-					Body: nil,
-				}
-			case PlayerAction:
-				log.Println("Sending a player action message")
-				env = Envelope{
-					Type: "action",
-					Body: message,
+				client.conn.SetWriteDeadline(time.Now().Add(wait))
+				err := client.conn.WriteJSON(wrap(message))
+				if err != nil {
+					log.Println("Received error writing json to client:", err)
+					return
 				}
 			}
 
-			err := client.conn.WriteJSON(env)
+			if !open {
+				log.Println("Client outbox closed..")
+				client.conn.SetWriteDeadline(time.Now().Add(wait))
+				client.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+		case <-ticker.C:
+
+			client.conn.SetWriteDeadline(time.Now().Add(wait))
+			err := client.conn.WriteMessage(websocket.PingMessage, nil)
 			if err != nil {
-				log.Println("Received error writing json to client:", err)
+				log.Println("Received error pinging client:", err)
 				return
 			}
 		}
 	}
 }
 
+// wrap puts the message in an envelope
+// labeled with its type for the browser
+func wrap(message interface{}) Envelope {
+
+	env := Envelope{}
+
+	switch message.(type) {
+	case *Noun:
+		log.Println("Sending a Noun")
+		env = Envelope{
+			Type: "noun",
+			Body: message,
+		}
+	case *Guess:
+		log.Println("Sending a Guess")
+		env = Envelope{
+			Type: "guess",
+			Body: message,
+		}
+	case *Hint:
+		log.Println("Sending a Hint")
+		env = Envelope{
+			Type: "hint",
+			Body: message,
+		}
+	case Start:
+		log.Println("Sending a start message")
+		env = Envelope{
+			Type: "start",
+			Body: nil,
+		}
+	case PlayerAction:
+		log.Println("Sending a player action message")
+		env = Envelope{
+			Type: "action",
+			Body: message,
+		}
+	case *State:
+		log.Println("Sending a state snapshot")
+		env = Envelope{
+			Type: "state",
+			Body: message,
+		}
+	case *MatchRecord:
+		log.Println("Sending the final scores")
+		env = Envelope{
+			Type: "over",
+			Body: message,
+		}
+	case *SettingsUpdate:
+		log.Println("Sending the room settings")
+		env = Envelope{
+			Type: "settings",
+			Body: message,
+		}
+	case Envelope:
+		// relayed from another instance already wrapped
+		env = message.(Envelope)
+	}
+
+	return env
+}
+
+// close tears the client down exactly once no matter whether
+// the reader, the writer or the room notices the problem first
+func (client *Client) close() {
+
+	client.teardown.Do(func() {
+		client.conn.Close() // kill the socket
+		client.checkout()
+	})
+}
+
+// checkout lets the room know the client has left
+// if the room has already closed there is nobody to tell
+func (client *Client) checkout() {
+
+	select {
+	case client.room.checkout <- client:
+	case <-client.room.done:
+	}
+}
+
+// do hands a command to the room so that the game
+// is only ever touched by the room's routine
+func (client *Client) do(command interface{}) {
+
+	client.room.do(command)
+}
+
 // addGuestName adds the guestname for the guest
 func addGuestName(res http.ResponseWriter, req *http.Request) {
 
@@ -262,63 +365,56 @@ func addGuestName(res http.ResponseWriter, req *http.Request) {
 		MaxAge:   0,
 	}
 
-	http.SetCookie(res, gnc)
+	SetSigned(res, gnc)
 }
 
-// addUserId adds or bumps out the guests session
-func addUserID(res http.ResponseWriter, req *http.Request) {
+// addSpectator remembers whether the guest
+// joined to play or just to watch
+func addSpectator(res http.ResponseWriter, req *http.Request) {
 
-	uid, err := req.Cookie("uid")
+	spectator := "false"
+	if req.Form.Get("spectator") != "" {
+		spectator = "true"
+	}
 
-	maxSession := int(time.Duration(time.Hour)/time.Second) * 2
+	SetSigned(res, &http.Cookie{
+		Name:     "spectator",
+		Value:    spectator,
+		HttpOnly: true,
+		MaxAge:   0,
+	})
+}
 
-	if err == http.ErrNoCookie {
+// addUserId adds or bumps out the guests session
+func addUserID(res http.ResponseWriter, req *http.Request) string {
 
-		uid = &http.Cookie{
+	value, err := ReadSigned(req, "uid")
 
-			Name:  "uid",
-			Value: uuid.New().String(),
-			// Secure: true,
-			HttpOnly: true,
-			MaxAge:   maxSession,
-		}
+	maxSession := int(time.Duration(time.Hour)/time.Second) * 2
 
-	} else if err != nil {
+	if err == ErrBadSignature {
 
+		// somebody made this one up so they get a new one
 		log.Println("Error checking uid cookie..", err)
+		value = uuid.New().String()
 
-	} else {
+	} else if err != nil {
 
-		// bump out the session
-		uid.MaxAge = maxSession
+		value = uuid.New().String()
 	}
 
-	http.SetCookie(res, uid)
-
-	// TO DO : put this in a better spot
-	go cleanSessionStorage()
-}
-
-// CleanSessionStorage periodically goes through all the stored sessions
-// and removes any that have not been active for 3 hours or more
-// This is the best we can do for now but this could be better
-func cleanSessionStorage() {
-
-	if time.Now().Sub(lastClean) > (time.Second * 30) {
-
-		log.Println("Running session cleanup..")
-		i := 0
-
-		for key, session := range sessions {
-			if time.Now().Sub(session.lastActivity) > (time.Hour * 3) {
-				delete(sessions, key)
-				i++
-			}
-		}
-		log.Println("Removed", i, "old sessions..")
+	// setting it again bumps out the session
+	// and moves it on to the newest key
+	SetSigned(res, &http.Cookie{
+		Name:  "uid",
+		Value: value,
+		// Secure: true,
+		HttpOnly: true,
+		MaxAge:   maxSession,
+	})
+	sessions.Open(value)
 
-		lastClean = time.Now()
-	}
+	return value
 }
 
 //***********************************************************************************************
@@ -328,18 +424,28 @@ func cleanSessionStorage() {
 //***********************************************************************************************
 
 // Client is a middleman connection and the room
+// the user id never leaves the server, the game and everyone
+// else knows them by the hashed id the history uses
 type Client struct {
-	room   *Room
-	conn   *websocket.Conn
-	UserID string `json:"userID"`
-	Name   string `json:"name"`
-	send   chan interface{}
-}
-
-// Session tracks the client and the time they were last active
-type Session struct {
-	client       *Client
-	lastActivity time.Time
+	room      *Room
+	conn      *websocket.Conn
+	UserID    string `json:"-"`
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Spectator bool   `json:"spectator"`
+	send      *Outbox
+	admit     chan error
+
+	// which connection to the game this was, for the journal
+	visit int
+
+	// clients relayed between instances are known by
+	// the instance they're connected to and the key it gave them
+	instance string
+	key      string
+
+	// makes sure the client only gets torn down once
+	teardown sync.Once
 }
 
 // Envelope allows for better json comms on the websocket
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestKeepalive(t *testing.T) {
+
+	period, wait := *pingPeriod, *pongWait
+	*pingPeriod, *pongWait = time.Millisecond*50, time.Millisecond*150
+	defer func() { *pingPeriod, *pongWait = period, wait }()
+
+	server := httptest.NewServer(RequireSession(socketHandler, refuseSocket))
+	defer server.Close()
+
+	room := CreateRoom("", false)
+
+	// answers pings like any browser would
+	alive, err := dialRoom(server, room, "keepalive-alive")
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer alive.Close()
+
+	// went to sleep and never answers
+	asleep, err := dialRoom(server, room, "keepalive-asleep")
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer asleep.Close()
+	asleep.SetPingHandler(func(string) error { return nil })
+
+	// both clients read in the background, which is where pongs get sent
+	listen := func(conn *websocket.Conn, errs chan error) {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}
+
+	died := make(chan error, 1)
+	dropped := make(chan error, 1)
+	go listen(alive, died)
+	go listen(asleep, dropped)
+
+	select {
+	case <-dropped:
+	case <-time.After(time.Second):
+		t.Error("Expected", "sleeping client to be dropped", "got", "still connected")
+	}
+
+	// the healthy client should outlive the pong wait
+	select {
+	case err := <-died:
+		t.Error("Expected", "healthy client to stay connected", "got", err)
+	case <-time.After(*pongWait * 2):
+	}
+}
+
+// socketPair connects a server side and a browser side websocket to each other
+func socketPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		conn, err := upgrader.Upgrade(res, req, nil)
+		if err != nil {
+			t.Error("Error upgrading conn to socket", err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal("Error dialing socket", err)
+	}
+	t.Cleanup(func() { peer.Close() })
+
+	return <-conns, peer
+}
+
+// teardown races a read error, a write error and optionally a room shutdown
+// and returns how many times the client checked out of the room
+func teardown(t *testing.T, shutdown bool) int {
+
+	conn, peer := socketPair(t)
+
+	room := &Room{
+		checkout: make(chan *Client, 3),
+		done:     make(chan struct{}),
+	}
+	client := &Client{
+		room: room,
+		conn: conn,
+		send: NewOutbox(1, Disconnect),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { reader(client); wg.Done() }()
+	go func() { writer(client); wg.Done() }()
+
+	start := make(chan struct{})
+	go func() { <-start; peer.Close() }()                             // read error
+	go func() { <-start; conn.Close(); client.send.Push(&Guess{}) }() // write error
+	go func() { <-start; client.send.Close() }()                      // dropped by the room
+	if shutdown {
+		go func() { <-start; close(room.done) }()
+	}
+	close(start)
+
+	finished := make(chan struct{})
+	go func() { wg.Wait(); close(finished) }()
+
+	select {
+	case <-finished:
+	case <-time.After(time.Second * 2):
+		t.Fatal("Expected", "reader and writer to stop", "got", "still running")
+	}
+
+	return len(room.checkout)
+}
+
+func TestMalformedMessageIgnored(t *testing.T) {
+
+	server := httptest.NewServer(RequireSession(socketHandler, refuseSocket))
+	defer server.Close()
+
+	room := CreateRoom("", false)
+
+	conn, err := dialRoom(server, room, "malformed-"+room.ID)
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer conn.Close()
+
+	envs := listen(conn)
+	await(t, envs, "state", nil)
+
+	// a message that doesn't parse is skipped and the client stays connected
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"message","body":{"message":1}}`))
+	conn.WriteJSON(Envelope{Type: "message", Body: map[string]string{"message": "still here"}})
+
+	await(t, envs, "guess", func(body json.RawMessage) bool {
+		return strings.Contains(string(body), "still here")
+	})
+}
+
+func TestClientTeardownOnce(t *testing.T) {
+
+	for i := 0; i < 20; i++ {
+		if n := teardown(t, false); n != 1 {
+			t.Fatal("Expected", "1 checkout", "got", n)
+		}
+	}
+}
+
+func TestClientTeardownDuringRoomShutdown(t *testing.T) {
+
+	for i := 0; i < 20; i++ {
+		if n := teardown(t, true); n > 1 {
+			t.Fatal("Expected", "at most 1 checkout", "got", n)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signs the session cookies so nobody can hand us someone else's uid
+var cookieKeys = NewKeyring()
+
+// How many keys are kept around to check cookies against
+// the newest one signs and the older ones keep cookies from
+// before the last rotations good until they get signed again
+const maxCookieKeys = 3
+
+// How often an instance sharing its keys will look for ones it hasn't seen
+// when a cookie doesn't check out, in case another instance rotated
+const keyringRefresh = 10 * time.Second
+
+// Where shared keys are kept in the backend
+const keyringKey = backendPrefix + "cookie-keys"
+
+// ErrBadSignature is a cookie we didn't sign or that was changed after we did
+var ErrBadSignature = errors.New("cookie signature doesn't match")
+
+//***********************************************************************************************
+//
+// External
+//
+//***********************************************************************************************
+
+// NewKeyring builds a keyring with a fresh key that only lives in memory
+// until it's opened on a file
+func NewKeyring() *Keyring {
+
+	return &Keyring{
+		keys: [][]byte{newKey()},
+	}
+}
+
+// Open loads the keys kept in the file, newest first
+// a missing file gets the keyring's current keys written to it
+func (k *Keyring) Open(path string) error {
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.path = path
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return k.save()
+	} else if err != nil {
+		return err
+	}
+
+	keys, err := parseKeys(string(data))
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		return k.save()
+	}
+
+	k.keys = keys
+	return nil
+}
+
+// Share keeps the keys in the backend so every instance signs and checks
+// cookies the same way, the first instance to share gets its keys used
+func (k *Keyring) Share(b Backend) error {
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.shared = b
+
+	claimed, err := b.Claim(keyringKey, encodeKeys(k.keys), 0)
+	if err != nil {
+		return err
+	}
+	if claimed {
+		k.loaded = time.Now()
+		return nil
+	}
+
+	if err := k.load(); err != nil {
+		return err
+	}
+	return k.save()
+}
+
+// Rotate starts signing with a new key
+// cookies signed with the old keys still check out so nobody gets
+// logged out and they pick up the new key the next time they're set
+func (k *Keyring) Rotate() error {
+
+	return k.rotate(0)
+}
+
+// SetSigned sets the cookie with its value signed
+func SetSigned(res http.ResponseWriter, cookie *http.Cookie) {
+
+	signed := *cookie
+	signed.Value = cookieKeys.sign(cookie.Name, cookie.Value)
+
+	http.SetCookie(res, &signed)
+}
+
+// ReadSigned gets the value of a cookie we signed
+// a cookie we didn't sign is as good as missing
+func ReadSigned(req *http.Request, name string) (string, error) {
+
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return "", err
+	}
+
+	return cookieKeys.verify(name, cookie.Value)
+}
+
+//***********************************************************************************************
+//
+// Internal
+//
+//***********************************************************************************************
+
+// rotate swaps in a new key, if the keys are shared and another
+// instance rotated within hold this one picks up their keys instead
+func (k *Keyring) rotate(hold time.Duration) error {
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.shared != nil {
+
+		if hold > 0 {
+
+			rotating, err := k.shared.Claim(keyringKey+":rotated", instanceID, hold)
+			if err != nil {
+				return err
+			}
+			if !rotating {
+
+				if err := k.load(); err != nil {
+					return err
+				}
+				return k.save()
+			}
+		}
+
+		// start from whatever the other instances have
+		if err := k.load(); err != nil {
+			return err
+		}
+	}
+
+	k.keys = append([][]byte{newKey()}, k.keys...)
+	if len(k.keys) > maxCookieKeys {
+		k.keys = k.keys[:maxCookieKeys]
+	}
+
+	if k.shared != nil {
+		if err := k.shared.Set(keyringKey, encodeKeys(k.keys), 0); err != nil {
+			return err
+		}
+	}
+
+	return k.save()
+}
+
+// refresh picks up keys another instance rotated in
+// it won't go back to the backend more often than the refresh period
+func (k *Keyring) refresh() bool {
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.shared == nil || time.Since(k.loaded) < keyringRefresh {
+		return false
+	}
+
+	if err := k.load(); err != nil {
+		log.Println("Error refreshing cookie keys", err)
+		return false
+	}
+	return true
+}
+
+// load reads the shared keys out of the backend
+// the lock must already be held
+func (k *Keyring) load() error {
+
+	value, ok, err := k.shared.Get(keyringKey)
+	if err != nil {
+		return err
+	}
+	k.loaded = time.Now()
+
+	if !ok {
+		return nil
+	}
+
+	keys, err := parseKeys(value)
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		k.keys = keys
+	}
+	return nil
+}
+
+// sign packs the value up with a signature from the newest key
+// the name is signed too so one cookie can't stand in for another
+// the value is encoded since browsers mangle spaces and anything past ascii
+func (k *Keyring) sign(name string, value string) string {
+
+	k.mu.RLock()
+	key := k.keys[0]
+	k.mu.RUnlock()
+
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(value))
+	mac := signature(key, name, encoded)
+
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac)
+}
+
+// verify checks the signature against every key we still have
+// and unpacks the value if one of them signed it
+// another instance may have signed it with a key we haven't picked up yet
+func (k *Keyring) verify(name string, signed string) (string, error) {
+
+	value, err := k.check(name, signed)
+	if err == ErrBadSignature && k.refresh() {
+		value, err = k.check(name, signed)
+	}
+	return value, err
+}
+
+// check looks for a key that signed the value
+func (k *Keyring) check(name string, signed string) (string, error) {
+
+	dot := strings.LastIndex(signed, ".")
+	if dot < 0 {
+		return "", ErrBadSignature
+	}
+	encoded := signed[:dot]
+
+	mac, err := base64.RawURLEncoding.DecodeString(signed[dot+1:])
+	if err != nil {
+		return "", ErrBadSignature
+	}
+
+	k.mu.RLock()
+	keys := k.keys
+	k.mu.RUnlock()
+
+	for _, key := range keys {
+
+		if !hmac.Equal(mac, signature(key, name, encoded)) {
+			continue
+		}
+
+		value, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", ErrBadSignature
+		}
+		return string(value), nil
+	}
+
+	return "", ErrBadSignature
+}
+
+// signature is the hmac of the cookie's name and encoded value
+func signature(key []byte, name string, encoded string) []byte {
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name + "=" + encoded))
+	return mac.Sum(nil)
+}
+
+// save writes the keys out if there's a file to write to
+// the lock must already be held
+func (k *Keyring) save() error {
+
+	if k.path == "" {
+		return nil
+	}
+
+	return writeFile(k.path, []byte(encodeKeys(k.keys)))
+}
+
+// encodeKeys writes the keys out one hex key per line
+func encodeKeys(keys [][]byte) string {
+
+	lines := []string{}
+	for _, key := range keys {
+		lines = append(lines, hex.EncodeToString(key))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// parseKeys reads keys written out one hex key per line
+func parseKeys(data string) ([][]byte, error) {
+
+	keys := [][]byte{}
+	for _, line := range strings.Split(data, "\n") {
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		key, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// rotateKeys swaps in a new signing key every so often for as long as the server is up
+// instances sharing keys only rotate once between them each time around
+func rotateKeys(k *Keyring, every time.Duration) {
+
+	for range time.Tick(every) {
+
+		if err := k.rotate(every - every/10); err != nil {
+			log.Println("Error rotating cookie keys", err)
+		}
+	}
+}
+
+// newKey makes a random key to sign with
+func newKey() []byte {
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalln("Error making a cookie key", err)
+	}
+	return key
+}
+
+//***********************************************************************************************
+//
+// Structs
+//
+//***********************************************************************************************
+
+// Keyring is the keys the session cookies are signed with, newest first
+// shared keys are kept in the backend and loaded is when they were last read
+type Keyring struct {
+	mu     sync.RWMutex
+	keys   [][]byte
+	path   string
+	shared Backend
+	loaded time.Time
+}
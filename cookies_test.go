@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSignedCookies(t *testing.T) {
+
+	k := NewKeyring()
+
+	signed := k.sign("guestname", "Zoë; the great")
+	if value, err := k.verify("guestname", signed); err != nil || value != "Zoë; the great" {
+		t.Error("Expected", "Zoë; the great", "got", value, err)
+	}
+
+	// a cookie can't stand in for a different one
+	if _, err := k.verify("uid", signed); err != ErrBadSignature {
+		t.Error("Expected", ErrBadSignature, "got", err)
+	}
+
+	// changing the value breaks the signature
+	parts := strings.Split(signed, ".")
+	forged := k.sign("guestname", "someone else")
+	forged = strings.Split(forged, ".")[0] + "." + parts[1]
+	if _, err := k.verify("guestname", forged); err != ErrBadSignature {
+		t.Error("Expected", ErrBadSignature, "got", err)
+	}
+
+	// and so does a cookie signed by some other server
+	if _, err := NewKeyring().verify("guestname", signed); err != ErrBadSignature {
+		t.Error("Expected", ErrBadSignature, "got", err)
+	}
+
+	for _, raw := range []string{"", "plain-uuid", "abc.def", "."} {
+		if _, err := k.verify("uid", raw); err != ErrBadSignature {
+			t.Error("Expected", ErrBadSignature, "got", err, "for", raw)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "keys.txt")
+
+	k := NewKeyring()
+	if err := k.Open(path); err != nil {
+		t.Fatal("Expected", nil, "got", err)
+	}
+	old := k.sign("uid", "rotate-me")
+
+	// cookies from before a rotation still work
+	if err := k.Rotate(); err != nil {
+		t.Fatal("Expected", nil, "got", err)
+	}
+	if value, err := k.verify("uid", old); err != nil || value != "rotate-me" {
+		t.Error("Expected", "rotate-me", "got", value, err)
+	}
+	if k.sign("uid", "rotate-me") == old {
+		t.Error("Expected", "a new signature", "got", old)
+	}
+
+	// the keys survive a restart
+	reopened := NewKeyring()
+	if err := reopened.Open(path); err != nil {
+		t.Fatal("Expected", nil, "got", err)
+	}
+	if value, err := reopened.verify("uid", old); err != nil || value != "rotate-me" {
+		t.Error("Expected", "rotate-me", "got", value, err)
+	}
+
+	// until enough rotations have gone by
+	for i := 1; i < maxCookieKeys; i++ {
+		k.Rotate()
+	}
+	if _, err := k.verify("uid", old); err != ErrBadSignature {
+		t.Error("Expected", ErrBadSignature, "got", err)
+	}
+}
+
+func TestForgedSessionIsTurnedAway(t *testing.T) {
+
+	room := CreateRoom("", false)
+
+	// somebody copying a uid they saw into their own cookie
+	req := httptest.NewRequest(http.MethodGet, "/room/"+room.ID, nil)
+	req.AddCookie(&http.Cookie{Name: "uid", Value: "someone-elses-uid"})
+	res := httptest.NewRecorder()
+	RequireSession(roomHandler, sendToJoin)(res, req)
+
+	if res.Code != http.StatusSeeOther || res.Header().Get("Location") != "/join" {
+		t.Error("Expected", "a redirect to /join", "got", res.Code, res.Header().Get("Location"))
+	}
+
+	// joining again hands out a new uid rather than keeping the forged one
+	req = httptest.NewRequest(http.MethodPost, "/join", nil)
+	req.AddCookie(&http.Cookie{Name: "uid", Value: "someone-elses-uid"})
+	res = httptest.NewRecorder()
+	uid := addUserID(res, req)
+
+	if uid == "someone-elses-uid" || uid == "" {
+		t.Error("Expected", "a new uid", "got", uid)
+	}
+
+	// a signed session gets the room page
+	req = httptest.NewRequest(http.MethodGet, "/room/"+room.ID, nil)
+	req.AddCookie(&http.Cookie{Name: "uid", Value: cookieKeys.sign("uid", uid)})
+	res = httptest.NewRecorder()
+	RequireSession(roomHandler, sendToJoin)(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Error("Expected", http.StatusOK, "got", res.Code)
+	}
+}
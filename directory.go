@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Keeps everyone in the lobby up to date on the public rooms
+var directory = NewDirectory()
+
+//***********************************************************************************************
+//
+// External
+//
+//***********************************************************************************************
+
+// NewDirectory builds the lobby directory and starts it up
+func NewDirectory() *Directory {
+
+	d := &Directory{
+		watchers: make(map[*Outbox]bool),
+		changes:  make(chan struct{}, 1),
+	}
+
+	go d.run()
+
+	return d
+}
+
+// Listings gathers up all the public rooms
+// the ones hosted here along with the ones every other instance shared
+func (d *Directory) Listings() []Listing {
+
+	listings := []Listing{}
+	seen := make(map[string]bool)
+
+	hotel.Range(func(room *Room) bool {
+
+		if room.Public {
+			listings = append(listings, room.Listing())
+			seen[room.ID] = true
+		}
+		return true
+	})
+
+	shared, err := backend.Scan(lobbyKey(""))
+	if err != nil {
+		log.Println("Error looking up the other instances' rooms", err)
+	}
+
+	for _, value := range shared {
+
+		var listing Listing
+		if err := json.Unmarshal([]byte(value), &listing); err != nil {
+			log.Println("Error reading a shared listing", err)
+			continue
+		}
+		if !seen[listing.ID] {
+			listings = append(listings, listing)
+			seen[listing.ID] = true
+		}
+	}
+
+	sort.Slice(listings, func(i, j int) bool { return listings[i].ID < listings[j].ID })
+
+	return listings
+}
+
+// Follow keeps the lobby up to date with the public rooms
+// on the other instances sharing the backend
+func (d *Directory) Follow(b Backend) error {
+
+	sub, err := b.Subscribe(lobbyChannel())
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for range sub.Messages() {
+			d.changed()
+		}
+	}()
+	return nil
+}
+
+// Serve keeps a lobby websocket up to date until it goes away
+func (d *Directory) Serve(conn *websocket.Conn) {
+
+	// only the latest listings matter so older ones get coalesced
+	watcher := NewOutbox(*sendQueue, Coalesce)
+	watcher.Push(d.Listings())
+
+	d.mu.Lock()
+	d.watchers[watcher] = true
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.watchers, watcher)
+		d.mu.Unlock()
+
+		watcher.Close()
+		conn.Close()
+	}()
+
+	// the lobby never sends us anything but we still
+	// need to read to notice when the browser goes away
+	go func() {
+
+		defer watcher.Close()
+
+		wait := *pongWait
+		conn.SetReadLimit(*maxMessageSize)
+		conn.SetReadDeadline(time.Now().Add(wait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wait))
+		})
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	wait := *writeWait
+	ticker := time.NewTicker(*pingPeriod)
+	defer ticker.Stop()
+
+	for {
+
+		select {
+
+		case <-watcher.Ready():
+
+			messages, open := watcher.Drain()
+
+			for _, message := range messages {
+
+				conn.SetWriteDeadline(time.Now().Add(wait))
+				err := conn.WriteJSON(Envelope{Type: "rooms", Body: message})
+				if err != nil {
+					log.Println("Received error writing json to lobby:", err)
+					return
+				}
+			}
+
+			if !open {
+				return
+			}
+
+		case <-ticker.C:
+
+			conn.SetWriteDeadline(time.Now().Add(wait))
+			err := conn.WriteMessage(websocket.PingMessage, nil)
+			if err != nil {
+				log.Println("Received error pinging lobby:", err)
+				return
+			}
+		}
+	}
+}
+
+//***********************************************************************************************
+//
+// Internal
+//
+//***********************************************************************************************
+
+// changed lets the directory know a public room has changed
+// it never blocks and several changes in a row only count once
+func (d *Directory) changed() {
+
+	select {
+	case d.changes <- struct{}{}:
+	default:
+	}
+}
+
+// run sends out fresh listings to everyone watching whenever something changes
+func (d *Directory) run() {
+
+	for range d.changes {
+
+		listings := d.Listings()
+
+		d.mu.Lock()
+		for watcher := range d.watchers {
+			if !watcher.Push(listings) {
+				watcher.Close()
+				delete(d.watchers, watcher)
+			}
+		}
+		d.mu.Unlock()
+	}
+}
+
+//***********************************************************************************************
+//
+// Structs
+//
+//***********************************************************************************************
+
+// Directory is the lobby's list of public rooms
+// along with everyone watching it for changes
+type Directory struct {
+	mu       sync.Mutex
+	watchers map[*Outbox]bool
+	changes  chan struct{}
+}
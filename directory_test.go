@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// listed finds the room in the listings
+func listed(listings []Listing, id string) (Listing, bool) {
+
+	for _, listing := range listings {
+		if listing.ID == id {
+			return listing, true
+		}
+	}
+	return Listing{}, false
+}
+
+func TestLobbyOnlyListsPublicRooms(t *testing.T) {
+
+	public := CreateRoom("", true)
+	hidden := CreateRoom("", false)
+	private := CreateRoom("secret", true)
+
+	req := httptest.NewRequest(http.MethodGet, "/lobby/rooms", nil)
+	res := httptest.NewRecorder()
+
+	lobbyRoomsHandler(res, req)
+
+	var listings []Listing
+	if err := json.NewDecoder(res.Body).Decode(&listings); err != nil {
+		t.Fatal("Error decoding listings", err)
+	}
+
+	listing, ok := listed(listings, public.ID)
+	if !ok {
+		t.Error("Expected", public.ID, "to be listed got", listings)
+	}
+	if listing.Phase != Lobby || listing.Mode != Classic || listing.MaxPlayers != *maxPlayers {
+		t.Error("Expected", "an empty classic room in the lobby", "got", listing)
+	}
+
+	// password protected rooms never show up even if asked to
+	for _, room := range []*Room{hidden, private} {
+		if _, ok := listed(listings, room.ID); ok {
+			t.Error("Expected", room.ID, "to be unlisted got", listings)
+		}
+	}
+}
+
+func TestLobbySocketGetsUpdates(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/lobby/ws" {
+			lobbySocketHandler(res, req)
+			return
+		}
+		RequireSession(socketHandler, refuseSocket)(res, req)
+	}))
+	defer server.Close()
+
+	room := CreateRoom("", true)
+
+	lobby, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/lobby/ws", nil)
+	if err != nil {
+		t.Fatal("Error dialing lobby", err)
+	}
+	defer lobby.Close()
+
+	envs := listen(lobby)
+
+	// the current rooms come straight away
+	await(t, envs, "rooms", func(body json.RawMessage) bool {
+		var listings []Listing
+		json.Unmarshal(body, &listings)
+		listing, ok := listed(listings, room.ID)
+		return ok && listing.Players == 0
+	})
+
+	player, err := dialRoom(server, room, room.ID+"-lobby-player")
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer player.Close()
+	listen(player)
+
+	// and a player taking a seat gets pushed out
+	await(t, envs, "rooms", func(body json.RawMessage) bool {
+		var listings []Listing
+		json.Unmarshal(body, &listings)
+		listing, ok := listed(listings, room.ID)
+		return ok && listing.Players == 1
+	})
+}
+
+func TestLobbyListsRoomsOnOtherInstances(t *testing.T) {
+
+	code := newCode()
+	shared, _ := json.Marshal(Listing{ID: code, Players: 2, MaxPlayers: 4, Phase: Lobby, Mode: Classic})
+	backend.Set(lobbyKey(code), string(shared), roomLease)
+	defer backend.Delete(lobbyKey(code))
+
+	listing, ok := listed(directory.Listings(), code)
+	if !ok || listing.Players != 2 {
+		t.Error("Expected", "the other instance's room", "got", listing, ok)
+	}
+
+	// and hears when they change
+	b := NewMemoryBackend()
+	d := NewDirectory()
+	if err := d.Follow(b); err != nil {
+		t.Fatal("Error following the lobby", err)
+	}
+
+	watcher := NewOutbox(8, Coalesce)
+	d.mu.Lock()
+	d.watchers[watcher] = true
+	d.mu.Unlock()
+
+	b.Publish(lobbyChannel(), []byte(code))
+
+	select {
+	case <-watcher.Ready():
+	case <-time.After(time.Second * 5):
+		t.Error("Expected", "fresh listings", "got", "nothing")
+	}
+}
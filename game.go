@@ -1,11 +1,14 @@
 package main
 
 import (
+	"errors"
 	"log"
 	"math/rand"
 	"regexp"
 	"strings"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 //***********************************************************************************************
@@ -22,14 +25,34 @@ type NounType string
 // can be performed by players
 type Action string
 
+// Phase is where the game is at
+// either waiting in the lobby or being played
+type Phase string
+
+// Mode is the set of rules the game is played by
+type Mode string
+
 const (
-	Person NounType = "person"
-	Place  NounType = "place"
-	Thing  NounType = "thing"
-	Join   Action   = "join"
-	Leave  Action   = "leave"
+	Person  NounType = "person"
+	Place   NounType = "place"
+	Thing   NounType = "thing"
+	Join    Action   = "join"
+	Leave   Action   = "leave"
+	Lobby   Phase    = "lobby"
+	Playing Phase    = "playing"
+	Classic Mode     = "classic"
+)
+
+// Reasons a client gets turned away from a room
+var (
+	ErrNoPlayerSpace    = errors.New("Sorry, this room already has all the players it can take.")
+	ErrNoSpectatorSpace = errors.New("Sorry, this room already has all the spectators it can take.")
 )
 
+// How many of the latest hints and guesses
+// the game holds on to for late joiners
+const recentLimit = 10
+
 //***********************************************************************************************
 //
 // Structs
@@ -38,34 +61,77 @@ const (
 
 // Game struct
 type Game struct {
-	Room         *Room
-	Nouns        Bowl
-	Players      Group
-	Presenter    *Player
-	Host         *Player
-	CurrentNoun  *Noun
-	IsStarted    bool
-	StartingTime time.Duration
-	Rounds       int
-	Broadcast    chan interface{}
+	Room        *Room
+	Nouns       Bowl
+	Players     Group
+	Spectators  []*Client
+	Presenter   *Player
+	Host        *Player
+	CurrentNoun *Noun
+	IsStarted   bool
+	StartedAt   time.Time
+	Round       int
+	Played      []NounRecord
+	Events      []Event
+	Hints       []Hint
+	Guesses     []Guess
+
+	// everything sent in to the game is kept in the journal
+	// so the same seed and journal always build the same game
+	Seed    int64
+	Journal []Entry
+	visits  int
+	rng     *rand.Rand
+
+	// while rebuilding the clock comes from the journal
+	// and nothing gets archived a second time
+	clock      time.Time
+	now        func() time.Time
+	rebuilding bool
 }
 
 // NewGame constructor for a game
 func NewGame(host *Player) Game {
 
 	game := Game{
-		Nouns:        Bowl{},
-		Players:      Group{},
-		Presenter:    nil,
-		Host:         host,
-		CurrentNoun:  nil,
-		StartingTime: 3,
-		Rounds:       3,
-		Broadcast:    make(chan interface{}),
+		Nouns:       Bowl{},
+		Players:     Group{},
+		Presenter:   nil,
+		Host:        host,
+		CurrentNoun: nil,
 	}
+	game.Reseed(time.Now().UnixNano())
 	return game
 }
 
+// Do runs a command sent in by one of the clients
+// this must only be called from the room's routine
+func (g *Game) Do(command interface{}) {
+
+	g.note(command)
+
+	switch c := command.(type) {
+
+	case Submission:
+		g.Nouns.Add(c.Nouns...)
+
+	case Message:
+		g.DoMessage(c)
+
+	case Start:
+		g.Start()
+
+	case ChangeSettings:
+		g.DoSettings(c)
+
+	case Pass:
+		g.DoPass(c)
+
+	default:
+		log.Printf("Game received an unknown command %T\n", command)
+	}
+}
+
 // Start begins the game
 func (g *Game) Start() {
 
@@ -74,70 +140,539 @@ func (g *Game) Start() {
 		return
 	}
 
+	// there has to be something in the bowl to guess
+	// and someone still here to present it
+	if len(g.Nouns.All) == 0 || g.Players.Here() == 0 {
+		log.Println("Can't start a game without any nouns or players..")
+		return
+	}
+
 	g.IsStarted = true
-	g.Players.Shuffle()
-	g.Nouns.Shuffle()
+	g.StartedAt = g.time()
+	g.Round = 1
+	g.Players.Shuffle(g.random())
+	g.Nouns.Shuffle(g.random())
+
+	// split everyone who is here up round robin if the host wants teams
+	here := 0
+	for _, p := range g.Players.All {
+		p.Score = 0
+		p.Team = 0
+		if teams := g.Room.Settings.Teams; teams > 0 && !p.Away {
+			p.Team = here%teams + 1
+		}
+		if !p.Away {
+			here++
+		}
+	}
 
-	g.Presenter = g.Players.First()
+	g.Presenter, _ = g.Players.FirstActive()
 	g.CurrentNoun = g.Nouns.First()
 
-	g.Broadcast <- Start{true}
+	// the replay starts from everyone's seats
+	g.Events = nil
+	g.logEvent(g.State(nil))
+
+	g.broadcast(Start{true})
+	g.Room.deliverTo(g.Presenter.Client, g.CurrentNoun)
+
+}
+
+// DoMessage treats a message from the presenter as a hint
+// and a message from anyone else as a guess
+func (g *Game) DoMessage(m Message) {
+
+	if g.Presenter != nil && g.Presenter.ID == m.client.ID {
+
+		hint := &Hint{
+			Text:   m.Text,
+			Type:   g.CurrentNoun.Type,
+			client: m.client,
+		}
 
-	// browser kills the socket if we
-	// send 2 messages rapid fire so delay
-	time.Sleep(time.Millisecond * 500)
-	g.Presenter.send <- g.CurrentNoun
+		g.Hints = append(g.Hints, *hint)
+		if len(g.Hints) > recentLimit {
+			g.Hints = g.Hints[1:]
+		}
+		g.broadcast(hint)
+		return
+	}
 
+	g.DoGuess(&Guess{
+		Text:   m.Text,
+		Player: m.client.Name,
+		client: m.client,
+	})
 }
 
 // DoGuess checks the guess against the current noun
 func (g *Game) DoGuess(guess *Guess) {
 
 	// check the guess
-	if g.CurrentNoun.Is(guess.Text) {
+	if g.CurrentNoun != nil && g.CurrentNoun.Is(guess.Text) {
 
 		guess.IsCorrect = true
 		guess.Noun = g.CurrentNoun.Text
 	}
 
 	// send out the results
+	g.Guesses = append(g.Guesses, *guess)
+	if len(g.Guesses) > recentLimit {
+		g.Guesses = g.Guesses[1:]
+	}
 	g.broadcast(guess)
 
-	// if it was correct send the next noun
-	if guess.IsCorrect {
+	// if it was correct take it out of the bowl and send the next noun
+	if guess.IsCorrect && g.Presenter != nil {
 
-		time.Sleep(time.Millisecond * 500)
-		g.CurrentNoun = g.Nouns.Next()
-		g.Presenter.send <- g.CurrentNoun
+		g.score(guess)
+
+		if !g.Nouns.Take() {
+			g.nextRound()
+			return
+		}
+
+		g.CurrentNoun = &g.Nouns.All[g.Nouns.Current]
+		g.Room.deliverTo(g.Presenter.Client, g.CurrentNoun)
 	}
 }
 
-// DoPass moves to the next noun in the bowl
-func (g *Game) DoPass() {
+// DoPass lets the presenter skip the noun
+// it stays in the bowl and they get the next one
+func (g *Game) DoPass(pass Pass) {
+
+	if g.Presenter == nil || g.Presenter.ID != pass.client.ID || g.CurrentNoun == nil {
+		return
+	}
 
 	g.CurrentNoun = g.Nouns.Next()
-	g.Presenter.send <- g.CurrentNoun
+	g.Room.deliverTo(g.Presenter.Client, g.CurrentNoun)
+}
+
+// DoSettings lets the host change the rules while everyone is still in the lobby
+// whatever the room ends up with gets sent out so every screen matches
+func (g *Game) DoSettings(c ChangeSettings) {
+
+	if err := g.checkSettings(c); err != nil {
+
+		log.Println("Turning down settings from", c.client.Name, err)
+		g.Room.deliverTo(c.client, &SettingsUpdate{
+			Settings: g.Room.Settings,
+			Error:    err.Error(),
+		})
+		return
+	}
+
+	g.Room.Settings = c.Settings
+	g.broadcast(&SettingsUpdate{Settings: g.Room.Settings})
+}
+
+// score gives a point to the guesser and the presenter
+// and keeps track of who got which noun for the history
+func (g *Game) score(guess *Guess) {
+
+	g.Presenter.IncrementScore(1)
+
+	guesser, ok := g.Players.Find(guess.client.ID)
+	if ok {
+		guesser.IncrementScore(1)
+	}
+
+	g.Played = append(g.Played, NounRecord{
+		Noun:          *g.CurrentNoun,
+		Round:         g.Round,
+		Presenter:     g.Presenter.ID,
+		PresenterName: g.Presenter.Name,
+		Guesser:       guess.client.ID,
+		GuesserName:   guess.client.Name,
+		GuessedAt:     g.time(),
+	})
+}
+
+// nextRound puts all the nouns back in the bowl once they've been guessed
+// and passes presenting along, after the last round the game is over
+func (g *Game) nextRound() {
+
+	if g.Round >= g.Room.Settings.Rounds {
+		g.finish()
+		return
+	}
+
+	g.Round++
+	g.Nouns.Refill(g.random())
+	g.handOff()
+	g.CurrentNoun = &g.Nouns.All[g.Nouns.Current]
+
+	g.broadcastState()
+}
+
+// finish records the game in the history and sends everyone back to the lobby
+func (g *Game) finish() {
+
+	match := g.record()
+	g.broadcast(&match)
+
+	// a rebuilt game was already archived the first time around
+	if !g.rebuilding {
+
+		if err := history.Add(match); err != nil {
+			log.Println("Error saving match to history", err)
+		}
+		if err := replays.Add(match.ID, g.Events); err != nil {
+			log.Println("Error saving replay", err)
+		}
+	}
+
+	// a fresh bowl for the next game
+	g.IsStarted = false
+	g.Round = 0
+	g.Played = nil
+	g.Events = nil
+	g.Presenter = nil
+	g.CurrentNoun = nil
+	g.Nouns = Bowl{}
+	g.Hints = nil
+	g.Guesses = nil
+	g.compact()
+
+	g.broadcastState()
+}
+
+// record writes up how the game went
+func (g *Game) record() MatchRecord {
+
+	now := g.time()
+
+	match := MatchRecord{
+		ID:        uuid.New().String(),
+		Room:      g.Room.ID,
+		Mode:      g.Room.Settings.Mode,
+		Rounds:    g.Round,
+		StartedAt: g.StartedAt,
+		EndedAt:   now,
+		Duration:  int64(now.Sub(g.StartedAt) / time.Second),
+		Nouns:     append([]NounRecord{}, g.Played...),
+	}
+
+	players := make(map[string]*PlayerRecord)
+	for _, p := range g.Players.All {
+
+		// the game counts for whoever is signed in as it finishes
+		account, _ := accounts.PlayerAccount(p.ID)
+
+		match.Players = append(match.Players, PlayerRecord{
+			ID:          p.ID,
+			Name:        p.Name,
+			Account:     account,
+			Team:        p.Team,
+			Score:       p.Score,
+			RoundScores: make([]int, g.Round),
+		})
+	}
+	for i := range match.Players {
+		players[match.Players[i].ID] = &match.Players[i]
+	}
+
+	for _, played := range g.Played {
+		for _, id := range []string{played.Presenter, played.Guesser} {
+			if p, ok := players[id]; ok {
+				p.RoundScores[played.Round-1]++
+			}
+		}
+	}
+
+	for team := 1; team <= g.Room.Settings.Teams; team++ {
+
+		total := TeamRecord{Team: team}
+		for _, p := range match.Players {
+			if p.Team == team {
+				total.Score += p.Score
+			}
+		}
+		match.Teams = append(match.Teams, total)
+	}
+
+	return match
 }
 
-// Join adds the client as a player
+// Admit checks that the room has space for the client
+// players who are still here can always open another connection
+// but players who left only get back in if there's a seat free
+func (g *Game) Admit(c *Client) error {
+
+	if c.Spectator {
+
+		if len(g.Spectators) >= g.Room.Settings.MaxSpectators {
+			return ErrNoSpectatorSpace
+		}
+		return nil
+	}
+
+	if p, ok := g.Players.Find(c.ID); ok && !p.Away {
+		return nil
+	}
+
+	if g.Players.Here() >= g.Room.Settings.MaxPlayers {
+		return ErrNoPlayerSpace
+	}
+	return nil
+}
+
+// Join adds the client as a player or if they have been
+// here before it gives them back their old seat and score
 func (g *Game) Join(c *Client) {
 
+	// spectators only ever watch
+	g.visits++
+	c.visit = g.visits
+	g.journal(JoinEntry, c, nil)
+
+	if c.Spectator {
+
+		g.Spectators = append(g.Spectators, c)
+		g.broadcastState()
+		return
+	}
+
+	if p, ok := g.Players.Find(c.ID); ok {
+
+		// whatever connection they had before is done for
+		if p.Client != c {
+			g.Room.kick(p.Client)
+		}
+		p.Client = c
+		p.Away = false
+		g.claimHost(p)
+
+		// pick up the game if nobody was left to present
+		if g.IsStarted && g.Presenter == nil {
+			g.handOff()
+		}
+
+		g.broadcastState()
+		return
+	}
+
 	p := &Player{Client: c}
 	g.Players.Add(p)
+	g.claimHost(p)
 
 	// let everyone know who joined
 	g.broadcast(PlayerAction{
 		Player: *p,
 		Action: Join,
 	})
+
+	// and catch the new player up on what they missed
+	g.Room.deliverTo(c, g.State(p))
 }
 
-// broadcast sends the payload to the channel
+// Leave marks the player as away so they can have their seat back later
+// and if they were presenting the next player takes over
+func (g *Game) Leave(c *Client) {
+
+	g.journal(LeaveEntry, c, nil)
+
+	if c.Spectator {
+
+		for i, spectator := range g.Spectators {
+			if spectator == c {
+				g.Spectators = append(g.Spectators[:i], g.Spectators[i+1:]...)
+				break
+			}
+		}
+		g.broadcastState()
+		return
+	}
+
+	p, ok := g.Players.Find(c.ID)
+
+	// skip if they already came back on another connection
+	if !ok || p.Client != c {
+		return
+	}
+
+	p.Away = true
+
+	// let everyone know who left
+	g.broadcast(PlayerAction{
+		Player: *p,
+		Action: Leave,
+	})
+
+	if g.Presenter == p {
+		g.handOff()
+	}
+
+	if g.Host == p {
+		g.passHost()
+	}
+
+	g.broadcastState()
+}
+
+// handOff passes the presenting over to the next player who is still here
+// the current noun stays in the bowl and the new presenter draws the next one
+func (g *Game) handOff() {
+
+	next, ok := g.Players.NextActive()
+	if !ok {
+		log.Println("Nobody left to present, waiting for someone to come back..")
+		g.Presenter = nil
+		return
+	}
+
+	g.Presenter = next
+
+	if len(g.Nouns.All) > 0 {
+		g.CurrentNoun = g.Nouns.Next()
+	}
+}
+
+// checkSettings makes sure the settings came from the host
+// before the game started and that the room can live with them
+func (g *Game) checkSettings(c ChangeSettings) error {
+
+	if g.Host == nil || g.Host.ID != c.client.ID {
+		return ErrNotHost
+	}
+
+	if g.IsStarted {
+		return ErrAlreadyStarted
+	}
+
+	if err := c.Settings.Validate(); err != nil {
+		return err
+	}
+
+	// nobody already here gets thrown out
+	if g.Players.Here() > c.Settings.MaxPlayers {
+		return ErrTooManyInRoom
+	}
+	if len(g.Spectators) > c.Settings.MaxSpectators {
+		return ErrTooManyWatching
+	}
+
+	return nil
+}
+
+// claimHost makes the player the host unless someone else already is
+func (g *Game) claimHost(p *Player) {
+
+	if g.Host == nil || g.Host.Away {
+		g.Host = p
+	}
+}
+
+// passHost hands hosting over to the first player who is still here
+// if everyone is gone the host keeps it until someone comes back
+func (g *Game) passHost() {
+
+	for _, p := range g.Players.All {
+		if !p.Away {
+			g.Host = p
+			return
+		}
+	}
+}
+
+// Phase works out where the game is at
+func (g *Game) Phase() Phase {
+
+	if g.IsStarted {
+		return Playing
+	}
+	return Lobby
+}
+
+// State takes a snapshot of the game as the player should see it
+// spectators get the snapshot without a player
+func (g *Game) State(p *Player) *State {
+
+	// everything is copied since the snapshot gets read by
+	// the clients writer while the game carries on
+	state := &State{
+		Players:    make([]Player, 0, len(g.Players.All)),
+		Spectators: len(g.Spectators),
+		Spectating: p == nil,
+		Phase:      g.Phase(),
+		IsStarted:  g.IsStarted,
+		Round:      g.Round,
+		IsHost:     p != nil && g.Host == p,
+		Settings:   g.Room.Settings,
+		Hints:      append([]Hint{}, g.Hints...),
+		Guesses:    append([]Guess{}, g.Guesses...),
+	}
+
+	for _, player := range g.Players.All {
+		state.Players = append(state.Players, *player)
+	}
+
+	if g.Presenter != nil {
+		presenter := *g.Presenter
+		state.Presenter = &presenter
+	}
+
+	if g.Host != nil {
+		host := *g.Host
+		state.Host = &host
+	}
+
+	if g.CurrentNoun != nil {
+		state.NounType = g.CurrentNoun.Type
+	}
+
+	if g.IsStarted {
+		state.Elapsed = int64(g.time().Sub(g.StartedAt) / time.Second)
+	}
+
+	// only the presenter gets to know the noun
+	if p != nil && g.Presenter == p && g.CurrentNoun != nil {
+		noun := *g.CurrentNoun
+		state.Noun = &noun
+	}
+
+	return state
+}
+
+// broadcastState sends every player and spectator their own snapshot of the game
+// the replay gets what a spectator would have seen
+func (g *Game) broadcastState() {
+
+	if g.IsStarted {
+		g.logEvent(g.State(nil))
+	}
+
+	for _, p := range g.Players.All {
+		if !p.Away {
+			g.Room.deliverTo(p.Client, g.State(p))
+		}
+	}
+
+	for _, c := range g.Spectators {
+		g.Room.deliverTo(c, g.State(nil))
+	}
+}
+
+// broadcast sends the payload to everyone in the room
+// and keeps it in the event log while the game is going
 func (g *Game) broadcast(i interface{}) {
 
-	go func() {
-		g.Broadcast <- i
-	}()
+	if g.IsStarted {
+		g.logEvent(i)
+	}
+	g.Room.deliver(i)
+}
+
+// end clears out the game once its room has closed
+func (g *Game) end() {
+
+	g.IsStarted = false
+	g.Presenter = nil
+	g.CurrentNoun = nil
+	g.Players = Group{}
+	g.Spectators = nil
+	g.Nouns = Bowl{}
 }
 
 // Bowl struct
@@ -165,11 +700,32 @@ func (b *Bowl) Next() *Noun {
 	return &b.All[b.Current]
 }
 
+// Take moves the current noun out to the guessed pile
+// and reports whether there are any left in the bowl
+func (b *Bowl) Take() bool {
+
+	b.Guessed = append(b.Guessed, b.All[b.Current])
+	b.All = append(b.All[:b.Current], b.All[b.Current+1:]...)
+
+	if b.Current >= len(b.All) {
+		b.Current = 0
+	}
+	return len(b.All) > 0
+}
+
+// Refill puts every guessed noun back in the bowl for the next round
+func (b *Bowl) Refill(rng *rand.Rand) {
+
+	b.All = append(b.All, b.Guessed...)
+	b.Guessed = nil
+	b.Current = 0
+	b.Shuffle(rng)
+}
+
 // Shuffle randomizes the slice
-func (b *Bowl) Shuffle() {
+func (b *Bowl) Shuffle(rng *rand.Rand) {
 
-	rand.Seed(time.Now().UnixNano())
-	rand.Shuffle(len(b.All),
+	rng.Shuffle(len(b.All),
 		func(i, j int) { b.All[i], b.All[j] = b.All[j], b.All[i] })
 }
 
@@ -227,7 +783,9 @@ func (n Noun) Is(s string) bool {
 // Player struct
 type Player struct {
 	*Client
-	Score int `json:"score"`
+	Score int  `json:"score"`
+	Team  int  `json:"team"`
+	Away  bool `json:"away"`
 }
 
 // PlayerAction composite
@@ -265,11 +823,38 @@ func (g *Group) Next() *Player {
 	return g.All[g.Current]
 }
 
+// FirstActive starts the turns over from the
+// first player in the slice who isn't away
+func (g *Group) FirstActive() (*Player, bool) {
+	g.Current = len(g.All) - 1
+	return g.NextActive()
+}
+
+// NextActive gets the next player in the slice who isn't away
+func (g *Group) NextActive() (*Player, bool) {
+	for range g.All {
+		if p := g.Next(); !p.Away {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// Here counts the players who aren't away
+func (g *Group) Here() int {
+	here := 0
+	for _, p := range g.All {
+		if !p.Away {
+			here++
+		}
+	}
+	return here
+}
+
 // Shuffle randomizes the slice
-func (g *Group) Shuffle() {
+func (g *Group) Shuffle(rng *rand.Rand) {
 
-	rand.Seed(time.Now().UnixNano())
-	rand.Shuffle(len(g.All),
+	rng.Shuffle(len(g.All),
 		func(i, j int) { g.All[i], g.All[j] = g.All[j], g.All[i] })
 }
 
@@ -278,6 +863,16 @@ func (g *Group) Add(others ...*Player) {
 	g.All = append(g.All, others...)
 }
 
+// Find looks up a player by their hashed id
+func (g *Group) Find(id string) (*Player, bool) {
+	for _, p := range g.All {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
 // Guess struct
 type Guess struct {
 	Text      string `json:"text"`
@@ -288,9 +883,10 @@ type Guess struct {
 }
 
 // Hint struct
+// only carries the type of noun since everyone gets to see it
 type Hint struct {
-	Text   string `json:"text"`
-	Noun   Noun   `json:"noun"`
+	Text   string   `json:"text"`
+	Type   NounType `json:"type"`
 	client *Client
 }
 
@@ -298,3 +894,41 @@ type Hint struct {
 type Start struct {
 	IsStarted bool
 }
+
+// State struct is a snapshot of the game
+// for a player who has just joined or come back
+type State struct {
+	Players    []Player     `json:"players"`
+	Spectators int          `json:"spectators"`
+	Spectating bool         `json:"spectating"`
+	Presenter  *Player      `json:"presenter"`
+	Host       *Player      `json:"host"`
+	IsHost     bool         `json:"isHost"`
+	Settings   RoomSettings `json:"settings"`
+	Phase      Phase        `json:"phase"`
+	IsStarted  bool         `json:"isStarted"`
+	Round      int          `json:"round"`
+	NounType   NounType     `json:"nounType"`
+	Hints      []Hint       `json:"hints"`
+	Guesses    []Guess      `json:"guesses"`
+	Elapsed    int64        `json:"elapsed"`
+	Noun       *Noun        `json:"noun,omitempty"`
+}
+
+// Pass struct is the presenter skipping their noun
+type Pass struct {
+	client *Client
+}
+
+// Submission struct carries a players nouns to the bowl
+type Submission struct {
+	Nouns  []Noun
+	client *Client
+}
+
+// Message struct is a line from a player which
+// is either a hint or a guess depending on who sent it
+type Message struct {
+	Text   string
+	client *Client
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Keeps the records of every game that has been played to the end
+var history = NewHistory()
+
+//***********************************************************************************************
+//
+// External
+//
+//***********************************************************************************************
+
+// NewHistory builds an empty history that only lives in memory
+// until it's opened on a file
+func NewHistory() *History {
+
+	return &History{
+		byID: make(map[string]int),
+	}
+}
+
+// Open loads every match already in the file and
+// appends new matches to the end of it from then on
+func (h *History) Open(path string) error {
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// one match per line
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+
+		var match MatchRecord
+		if err := json.Unmarshal(scanner.Bytes(), &match); err != nil {
+			file.Close()
+			return err
+		}
+		h.add(match)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return err
+	}
+
+	h.file = file
+	return nil
+}
+
+// Add records a finished match
+func (h *History) Add(match MatchRecord) error {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.file != nil {
+
+		line, err := json.Marshal(match)
+		if err != nil {
+			return err
+		}
+		if _, err := h.file.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+
+	h.add(match)
+	return nil
+}
+
+// Get looks up a match by its id
+func (h *History) Get(id string) (MatchRecord, bool) {
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	i, ok := h.byID[id]
+	if !ok {
+		return MatchRecord{}, false
+	}
+	return h.matches[i], true
+}
+
+// Find gets the matches played in a room and or by a player
+// newest first, leaving either blank matches everything
+func (h *History) Find(room string, player string) []MatchRecord {
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	found := []MatchRecord{}
+	for i := len(h.matches) - 1; i >= 0; i-- {
+
+		match := h.matches[i]
+		if room != "" && match.Room != room {
+			continue
+		}
+		if player != "" && !match.Played(player) {
+			continue
+		}
+		found = append(found, match)
+	}
+	return found
+}
+
+// PlayerID is how a player shows up in the history
+// the uid is hashed since anyone holding it could take their seat
+func PlayerID(uid string) string {
+
+	sum := sha256.Sum256([]byte(uid))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Played checks if the player was in the match
+func (m MatchRecord) Played(player string) bool {
+
+	for _, p := range m.Players {
+		if p.ID == player {
+			return true
+		}
+	}
+	return false
+}
+
+//***********************************************************************************************
+//
+// Internal
+//
+//***********************************************************************************************
+
+// add puts the match in memory
+// the lock must already be held
+func (h *History) add(match MatchRecord) {
+
+	h.byID[match.ID] = len(h.matches)
+	h.matches = append(h.matches, match)
+}
+
+//***********************************************************************************************
+//
+// Structs
+//
+//***********************************************************************************************
+
+// History is every finished match along with the file they're kept in
+type History struct {
+	mu      sync.RWMutex
+	matches []MatchRecord
+	byID    map[string]int
+	file    *os.File
+}
+
+// MatchRecord is how a finished game is remembered
+type MatchRecord struct {
+	ID        string         `json:"id"`
+	Room      string         `json:"room"`
+	Mode      Mode           `json:"mode"`
+	Rounds    int            `json:"rounds"`
+	StartedAt time.Time      `json:"startedAt"`
+	EndedAt   time.Time      `json:"endedAt"`
+	Duration  int64          `json:"duration"`
+	Players   []PlayerRecord `json:"players"`
+	Teams     []TeamRecord   `json:"teams,omitempty"`
+	Nouns     []NounRecord   `json:"nouns"`
+}
+
+// PlayerRecord is how a player did in a match
+// and which account they were signed in to if any
+type PlayerRecord struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Account     string `json:"account,omitempty"`
+	Team        int    `json:"team,omitempty"`
+	Score       int    `json:"score"`
+	RoundScores []int  `json:"roundScores"`
+}
+
+// TeamRecord is how a team did in a match
+type TeamRecord struct {
+	Team  int `json:"team"`
+	Score int `json:"score"`
+}
+
+// NounRecord is a noun that got guessed along with who presented and guessed it
+type NounRecord struct {
+	Noun          Noun      `json:"noun"`
+	Round         int       `json:"round"`
+	Presenter     string    `json:"presenter"`
+	PresenterName string    `json:"presenterName"`
+	Guesser       string    `json:"guesser"`
+	GuesserName   string    `json:"guesserName"`
+	GuessedAt     time.Time `json:"guessedAt"`
+}
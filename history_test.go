@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// playThrough runs a game between two players until it's over
+// with whoever isn't presenting guessing every noun right away
+func playThrough(t *testing.T, rounds int, teams int) *Room {
+
+	return playIn(t, buildRoom(newCode(), false), rounds, teams)
+}
+
+// playIn plays the game through in a room that's already been built
+// the players are the room's code followed by -ann and -bob
+func playIn(t *testing.T, room *Room, rounds int, teams int) *Room {
+
+	room.Settings.Rounds = rounds
+	room.Settings.Teams = teams
+
+	clients := []*Client{
+		{UserID: room.ID + "-ann", ID: PlayerID(room.ID + "-ann"), Name: "Ann", send: NewOutbox(64, DropOldest)},
+		{UserID: room.ID + "-bob", ID: PlayerID(room.ID + "-bob"), Name: "Bob", send: NewOutbox(64, DropOldest)},
+	}
+
+	g := room.CurrGame
+	for _, c := range clients {
+
+		room.clients[c] = true
+		g.Join(c)
+		g.Do(Submission{
+			Nouns:  []Noun{{Person, c.Name + " lovelace"}, {Place, c.Name + "ville"}, {Thing, c.Name + "phone"}},
+			client: c,
+		})
+	}
+
+	g.Do(Start{})
+
+	for turns := 0; g.IsStarted; turns++ {
+
+		if turns > 100 {
+			t.Fatal("Expected", "the game to end", "got", "more than 100 turns")
+		}
+
+		guesser := clients[0]
+		if g.Presenter.Client == guesser {
+			guesser = clients[1]
+		}
+		g.Do(Message{Text: g.CurrentNoun.Text, client: guesser})
+	}
+
+	return room
+}
+
+func TestFinishedGamesAreRecorded(t *testing.T) {
+
+	room := playThrough(t, 2, 2)
+
+	matches := history.Find(room.ID, "")
+	if len(matches) != 1 {
+		t.Fatal("Expected", 1, "got", len(matches))
+	}
+	match := matches[0]
+
+	if match.Rounds != 2 || len(match.Nouns) != 12 {
+		t.Error("Expected", "2 rounds of 6 nouns", "got", match.Rounds, len(match.Nouns))
+	}
+
+	// every noun is a point for the presenter and the guesser
+	total := 0
+	for _, p := range match.Players {
+
+		if len(p.RoundScores) != 2 || p.RoundScores[0]+p.RoundScores[1] != p.Score {
+			t.Error("Expected", "round scores adding up to", p.Score, "got", p.RoundScores)
+		}
+		if p.Team == 0 {
+			t.Error("Expected", "a team", "got", p.Team)
+		}
+		total += p.Score
+	}
+	if total != 24 {
+		t.Error("Expected", 24, "got", total)
+	}
+
+	if len(match.Teams) != 2 || match.Teams[0].Score+match.Teams[1].Score != 24 {
+		t.Error("Expected", "2 teams scoring 24", "got", match.Teams)
+	}
+
+	for _, played := range match.Nouns {
+		if played.Presenter == played.Guesser || played.Presenter == "" {
+			t.Error("Expected", "someone else to guess", "got", played)
+		}
+	}
+
+	// nobody's uid ever ends up in the record
+	if strings.Contains(toJSON(t, match), room.ID+"-ann") {
+		t.Error("Expected", "hashed player ids", "got", match.Players)
+	}
+
+	if mine := history.Find("", PlayerID(room.ID+"-ann")); len(mine) != 1 || mine[0].ID != match.ID {
+		t.Error("Expected", match.ID, "got", mine)
+	}
+
+	// and everyone is back in the lobby for another go
+	if room.CurrGame.Phase() != Lobby || len(room.CurrGame.Nouns.All) != 0 {
+		t.Error("Expected", "a fresh lobby", "got", room.CurrGame.Phase(), room.CurrGame.Nouns.All)
+	}
+}
+
+func TestHistoryEndpoints(t *testing.T) {
+
+	room := playThrough(t, 1, 0)
+	match := history.Find(room.ID, "")[0]
+
+	res := httptest.NewRecorder()
+	historyGamesHandler(res, httptest.NewRequest(http.MethodGet, "/history/games?uid="+room.ID+"-bob", nil))
+
+	var matches []MatchRecord
+	json.NewDecoder(res.Body).Decode(&matches)
+	if len(matches) != 1 || matches[0].ID != match.ID {
+		t.Error("Expected", match.ID, "got", matches)
+	}
+
+	res = httptest.NewRecorder()
+	matchGameHandler(res, httptest.NewRequest(http.MethodGet, "/history/games/nope", nil))
+	if res.Code != http.StatusNotFound {
+		t.Error("Expected", http.StatusNotFound, "got", res.Code)
+	}
+
+	res = httptest.NewRecorder()
+	matchHandler(res, httptest.NewRequest(http.MethodGet, "/history/"+match.ID, nil))
+	if body := res.Body.String(); !strings.Contains(body, "Bob") || !strings.Contains(body, room.ID) {
+		t.Error("Expected", "the match page", "got", body)
+	}
+
+	// asking for your own games goes off the cookie
+	sessions.Open(room.ID + "-ann")
+	req := httptest.NewRequest(http.MethodGet, "/history?mine=true", nil)
+	req.AddCookie(&http.Cookie{Name: "uid", Value: cookieKeys.sign("uid", room.ID+"-ann")})
+	res = httptest.NewRecorder()
+	WithSession(http.HandlerFunc(historyHandler)).ServeHTTP(res, req)
+	if body := res.Body.String(); !strings.Contains(body, "/history/"+match.ID) {
+		t.Error("Expected", "the match to be listed", "got", body)
+	}
+}
+
+func TestHistoryFileSurvivesRestart(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+
+	before := NewHistory()
+	if err := before.Open(path); err != nil {
+		t.Fatal("Error opening history", err)
+	}
+	for _, id := range []string{"first", "second"} {
+		before.Add(MatchRecord{ID: id, Room: "FILE", Players: []PlayerRecord{{ID: "p1"}}})
+	}
+
+	after := NewHistory()
+	if err := after.Open(path); err != nil {
+		t.Fatal("Error opening history", err)
+	}
+
+	matches := after.Find("FILE", "p1")
+	if len(matches) != 2 || matches[0].ID != "second" {
+		t.Error("Expected", "both matches newest first", "got", matches)
+	}
+	if _, ok := after.Get("first"); !ok {
+		t.Error("Expected", "first", "got", "nothing")
+	}
+}
+
+// toJSON marshals the value for checking what ends up on the wire
+func toJSON(t *testing.T, v interface{}) string {
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal("Error marshalling", err)
+	}
+	return string(data)
+}
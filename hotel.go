@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+)
+
+//***********************************************************************************************
+//
+// External
+//
+//***********************************************************************************************
+
+// NewHotel builds an empty room registry
+func NewHotel() *Hotel {
+
+	return &Hotel{
+		rooms: make(map[string]*Room),
+	}
+}
+
+// Get checks for a specific room by its id
+func (h *Hotel) Get(id string) (*Room, bool) {
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	room, ok := h.rooms[id]
+	return room, ok
+}
+
+// Put adds or replaces a room in the registry
+func (h *Hotel) Put(room *Room) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.rooms[room.ID] = room
+}
+
+// Insert adds a room to the registry unless its id is already taken
+func (h *Hotel) Insert(room *Room) bool {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, taken := h.rooms[room.ID]; taken {
+		return false
+	}
+
+	h.rooms[room.ID] = room
+	return true
+}
+
+// Delete removes a room from the registry
+func (h *Hotel) Delete(id string) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.rooms, id)
+}
+
+// Range calls f for every room in the registry until f returns false
+// the rooms are copied out first so f is free to modify the registry
+func (h *Hotel) Range(f func(room *Room) bool) {
+
+	h.mu.RLock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, room := range h.rooms {
+		rooms = append(rooms, room)
+	}
+	h.mu.RUnlock()
+
+	for _, room := range rooms {
+		if !f(room) {
+			return
+		}
+	}
+}
+
+// Len counts the rooms in the registry
+func (h *Hotel) Len() int {
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.rooms)
+}
+
+//***********************************************************************************************
+//
+// Structs
+//
+//***********************************************************************************************
+
+// Hotel is a registry of all the open rooms
+// and is safe to use from multiple routines
+type Hotel struct {
+	mu    sync.RWMutex
+	rooms map[string]*Room
+}
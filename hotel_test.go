@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHotelConcurrentAccess(t *testing.T) {
+
+	h := NewHotel()
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 50; i++ {
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			id := fmt.Sprint(i)
+			h.Put(&Room{ID: id})
+			h.Get(id)
+			h.Range(func(room *Room) bool { return true })
+
+			if i%2 == 0 {
+				h.Delete(id)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if h.Len() != 25 {
+		t.Error("Expected", 25, "got", h.Len())
+	}
+}
+
+func TestSessionStoreConcurrentAccess(t *testing.T) {
+
+	s := NewSessionStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+
+		wg.Add(1)
+		go func(uid string) {
+			defer wg.Done()
+
+			s.Put(uid, &Session{lastActivity: time.Now()})
+			s.Get(uid)
+			s.Range(func(uid string, session *Session) bool { return true })
+			s.Touch(uid)
+			s.Expire(time.Hour)
+		}(fmt.Sprint(i))
+	}
+	wg.Wait()
+
+	if s.Len() != 50 {
+		t.Error("Expected", 50, "got", s.Len())
+	}
+}
+
+func TestConcurrentJoins(t *testing.T) {
+
+	server := httptest.NewServer(RequireSession(socketHandler, refuseSocket))
+	defer server.Close()
+
+	joins := 20
+
+	// make sure the room has a seat for everyone
+	limit := *maxPlayers
+	*maxPlayers = joins
+	room := CreateRoom("", false)
+	*maxPlayers = limit
+
+	before := sessions.Len()
+
+	var wg sync.WaitGroup
+	conns := make(chan *websocket.Conn, joins)
+	for i := 0; i < joins; i++ {
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			conn, err := dialRoom(server, room, fmt.Sprintf("join-test-%v-%v", room.ID, i))
+			if err != nil {
+				t.Error("Error dialing room", err)
+				return
+			}
+			conns <- conn
+		}(i)
+	}
+	wg.Wait()
+	close(conns)
+
+	deadline := time.Now().Add(time.Second * 5)
+	for sessions.Len() < before+joins && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if sessions.Len() != before+joins {
+		t.Error("Expected", before+joins, "sessions got", sessions.Len())
+	}
+
+	for conn := range conns {
+		conn.Close()
+	}
+}
+
+func TestSessionsExpire(t *testing.T) {
+
+	s := NewSessionStore()
+	s.Put("idle", &Session{lastActivity: time.Now().Add(-time.Hour * 2)})
+	s.Put("busy", &Session{lastActivity: time.Now().Add(-time.Hour * 2)})
+	s.Touch("busy")
+
+	s.Start(time.Millisecond*10, time.Hour)
+
+	deadline := time.Now().Add(time.Second * 5)
+	for s.Len() > 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if _, ok := s.Get("idle"); ok {
+		t.Error("Expected", "the idle session to expire", "got", "it still there")
+	}
+	if _, ok := s.Get("busy"); !ok {
+		t.Error("Expected", "the busy session to stay", "got", "it expired")
+	}
+
+	// and the other instances hear it's still going
+	shared := func() bool {
+		_, ok, _ := backend.Get(sessionKey("busy"))
+		return ok
+	}
+	for !shared() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !shared() {
+		t.Error("Expected", "the busy session to be shared", "got", "nothing")
+	}
+
+	// closing waits on the worker and is fine to do twice
+	s.Close()
+	s.Close()
+
+	// a store that never started closes right away too
+	NewSessionStore().Close()
+}
+
+func TestMessagesTouchSession(t *testing.T) {
+
+	server := httptest.NewServer(RequireSession(socketHandler, refuseSocket))
+	defer server.Close()
+
+	room := CreateRoom("", false)
+	uid := "touch-" + room.ID
+
+	conn, err := dialRoom(server, room, uid)
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(time.Second * 5)
+	session, ok := sessions.Get(uid)
+	for !ok && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+		session, ok = sessions.Get(uid)
+	}
+	if !ok {
+		t.Fatal("Expected", "a session", "got", "none")
+	}
+
+	// pretend they've been quiet for a while
+	long := time.Now().Add(-time.Hour)
+	sessions.mu.Lock()
+	session.lastActivity = long
+	sessions.mu.Unlock()
+
+	conn.WriteJSON(Envelope{Type: "message", Body: map[string]string{"message": "hello"}})
+
+	for time.Now().Before(deadline) {
+
+		sessions.mu.RLock()
+		touched := session.lastActivity.After(long)
+		sessions.mu.RUnlock()
+
+		if touched {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Error("Expected", "the message to touch the session", "got", "it still idle")
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+//***********************************************************************************************
+//
+// Enums
+//
+//***********************************************************************************************
+
+// EntryKind is what happened in a journal entry
+type EntryKind string
+
+const (
+	JoinEntry       EntryKind = "join"
+	LeaveEntry      EntryKind = "leave"
+	SubmitEntry     EntryKind = "submit"
+	StartEntry      EntryKind = "start"
+	MessageEntry    EntryKind = "message"
+	PassEntry       EntryKind = "pass"
+	SettingsEntry   EntryKind = "settings"
+	RestartEntry    EntryKind = "restart"
+	CheckpointEntry EntryKind = "checkpoint"
+)
+
+//***********************************************************************************************
+//
+// External
+//
+//***********************************************************************************************
+
+// Reseed starts the game's random numbers over from the seed
+// the same seed always shuffles the same way
+func (g *Game) Reseed(seed int64) {
+
+	g.Seed = seed
+	g.rng = rand.New(rand.NewSource(seed))
+}
+
+// Rebuild plays a journal back into a fresh game
+// the game has to be seeded the same way the original was and
+// nothing is sent anywhere since the room has nobody in it yet
+func (g *Game) Rebuild(entries []Entry) error {
+
+	g.rebuilding = true
+	defer func() {
+		g.rebuilding = false
+		g.now = nil
+	}()
+
+	// the connections that joined along the way
+	clients := make(map[int]*Client)
+
+	for i, entry := range entries {
+
+		at := entry.At
+		g.now = func() time.Time { return at }
+
+		if entry.Kind == JoinEntry {
+
+			c := &Client{
+				ID:        seatedAs(entry.Player, entry.UserID),
+				Name:      entry.Name,
+				Spectator: entry.Spectator,
+			}
+			g.Join(c)
+			clients[c.visit] = c
+			continue
+		}
+
+		if entry.Kind == RestartEntry {
+			g.Restart()
+			continue
+		}
+
+		if entry.Kind == CheckpointEntry {
+
+			var checkpoint Checkpoint
+			if err := json.Unmarshal(entry.Body, &checkpoint); err != nil {
+				return fmt.Errorf("entry %v has a bad checkpoint: %v", i, err)
+			}
+			clients = g.resume(checkpoint)
+			continue
+		}
+
+		c, ok := clients[entry.Visit]
+		if !ok && entry.Kind != StartEntry {
+			return fmt.Errorf("entry %v is from a connection that never joined", i)
+		}
+
+		if entry.Kind == LeaveEntry {
+			g.Leave(c)
+			continue
+		}
+
+		command, err := decodeCommand(entry.Kind, entry.Body, c)
+		if err != nil {
+			return fmt.Errorf("entry %v %v", i, err)
+		}
+		g.Do(command)
+	}
+
+	return nil
+}
+
+// Restart is what happens to the game when the server comes back up
+// every player is away and nobody is presenting
+// so the first player back picks the game up again
+func (g *Game) Restart() {
+
+	g.journal(RestartEntry, nil, nil)
+
+	for _, p := range g.Players.All {
+		p.Away = true
+	}
+	g.Spectators = nil
+	g.Presenter = nil
+}
+
+//***********************************************************************************************
+//
+// Internal
+//
+//***********************************************************************************************
+
+// compact starts the journal over from the room as it is between games
+// so a finished game is never saved or played back again
+// the new seed comes from the old one so rebuilding still lands in the same place
+func (g *Game) compact() {
+
+	checkpoint := Checkpoint{
+		Turn:     g.Players.Current,
+		Visits:   g.visits,
+		Settings: g.Room.Settings,
+	}
+
+	for _, p := range g.Players.All {
+		checkpoint.Players = append(checkpoint.Players, Seat{
+			Player: p.ID,
+			Name:   p.Name,
+			Score:  p.Score,
+			Team:   p.Team,
+			Away:   p.Away,
+			Visit:  p.visit,
+		})
+	}
+
+	for _, c := range g.Spectators {
+		checkpoint.Spectators = append(checkpoint.Spectators, Seat{
+			Player: c.ID,
+			Name:   c.Name,
+			Visit:  c.visit,
+		})
+	}
+
+	if g.Host != nil {
+		checkpoint.Host = g.Host.ID
+	}
+
+	g.Reseed(g.random().Int63())
+	g.Journal = nil
+	g.journal(CheckpointEntry, nil, checkpoint)
+}
+
+// resume puts everyone back where the checkpoint left them
+// and hands back their connections so later entries can find them
+func (g *Game) resume(checkpoint Checkpoint) map[int]*Client {
+
+	g.journal(CheckpointEntry, nil, checkpoint)
+
+	clients := make(map[int]*Client)
+
+	g.Players = Group{Current: checkpoint.Turn}
+	g.Spectators = nil
+	g.Host = nil
+	g.visits = checkpoint.Visits
+	g.Room.Settings = checkpoint.Settings
+
+	for _, seat := range checkpoint.Players {
+
+		c := &Client{ID: seat.Player, Name: seat.Name, visit: seat.Visit}
+		p := &Player{
+			Client: c,
+			Score:  seat.Score,
+			Team:   seat.Team,
+			Away:   seat.Away,
+		}
+		g.Players.Add(p)
+		clients[seat.Visit] = c
+
+		if seat.Player == checkpoint.Host {
+			g.Host = p
+		}
+	}
+
+	for _, seat := range checkpoint.Spectators {
+
+		c := &Client{ID: seat.Player, Name: seat.Name, Spectator: true, visit: seat.Visit}
+		g.Spectators = append(g.Spectators, c)
+		clients[seat.Visit] = c
+	}
+
+	return clients
+}
+
+// note adds a command to the journal
+func (g *Game) note(command interface{}) {
+
+	if kind, c, body, ok := encodeCommand(command); ok {
+		g.journal(kind, c, body)
+	}
+}
+
+// encodeCommand works out how a command gets written down
+// which kind it is, who sent it and what was in it
+func encodeCommand(command interface{}) (EntryKind, *Client, interface{}, bool) {
+
+	switch c := command.(type) {
+
+	case Submission:
+		return SubmitEntry, c.client, c.Nouns, true
+
+	case Message:
+		return MessageEntry, c.client, c.Text, true
+
+	case Start:
+		return StartEntry, nil, nil, true
+
+	case Pass:
+		return PassEntry, c.client, nil, true
+
+	case ChangeSettings:
+		return SettingsEntry, c.client, c.Settings, true
+	}
+
+	return "", nil, nil, false
+}
+
+// decodeCommand turns a written down command back into one the game can do
+func decodeCommand(kind EntryKind, body json.RawMessage, c *Client) (interface{}, error) {
+
+	switch kind {
+
+	case SubmitEntry:
+		var nouns []Noun
+		if err := json.Unmarshal(body, &nouns); err != nil {
+			return nil, fmt.Errorf("has a bad submission: %v", err)
+		}
+		return Submission{Nouns: nouns, client: c}, nil
+
+	case StartEntry:
+		return Start{}, nil
+
+	case MessageEntry:
+		var text string
+		if err := json.Unmarshal(body, &text); err != nil {
+			return nil, fmt.Errorf("has a bad message: %v", err)
+		}
+		return Message{Text: text, client: c}, nil
+
+	case PassEntry:
+		return Pass{client: c}, nil
+
+	case SettingsEntry:
+		var settings RoomSettings
+		if err := json.Unmarshal(body, &settings); err != nil {
+			return nil, fmt.Errorf("has bad settings: %v", err)
+		}
+		return ChangeSettings{Settings: settings, client: c}, nil
+	}
+
+	return nil, fmt.Errorf("is an unknown kind %q", kind)
+}
+
+// journal adds an entry for something sent in by the client
+// joins keep who the client is so they can be put back later
+func (g *Game) journal(kind EntryKind, c *Client, body interface{}) {
+
+	// the game's clock stops at the entry so everything
+	// the command does happens at the time it was written down
+	g.clock = time.Now()
+	if g.now != nil {
+		g.clock = g.now()
+	}
+
+	entry := Entry{
+		At:   g.clock,
+		Kind: kind,
+	}
+
+	if c != nil {
+		entry.Visit = c.visit
+	}
+
+	if kind == JoinEntry {
+		entry.Player = c.ID
+		entry.Name = c.Name
+		entry.Spectator = c.Spectator
+	}
+
+	if body != nil {
+
+		data, err := json.Marshal(body)
+		if err != nil {
+			log.Println("Error writing to the journal", err)
+			return
+		}
+		entry.Body = data
+	}
+
+	g.Journal = append(g.Journal, entry)
+}
+
+// random gets the game's random numbers
+// seeding from the clock if nobody picked a seed
+func (g *Game) random() *rand.Rand {
+
+	if g.rng == nil {
+		g.Reseed(time.Now().UnixNano())
+	}
+	return g.rng
+}
+
+// seatedAs is the hashed id a saved player goes by
+// older saves only have their user id
+func seatedAs(player string, uid string) string {
+
+	if player == "" && uid != "" {
+		return PlayerID(uid)
+	}
+	return player
+}
+
+// time is when the latest journal entry was written
+func (g *Game) time() time.Time {
+
+	if g.clock.IsZero() {
+		return time.Now()
+	}
+	return g.clock
+}
+
+//***********************************************************************************************
+//
+// Structs
+//
+//***********************************************************************************************
+
+// Entry is something sent in to the game
+// visit is which connection it came from and player is the hashed
+// id of whoever joined, older saves have their user id instead
+type Entry struct {
+	At        time.Time       `json:"at"`
+	Kind      EntryKind       `json:"kind"`
+	Visit     int             `json:"visit,omitempty"`
+	Player    string          `json:"player,omitempty"`
+	UserID    string          `json:"userID,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Spectator bool            `json:"spectator,omitempty"`
+	Body      json.RawMessage `json:"body,omitempty"`
+}
+
+// Checkpoint is the room as a finished game left it
+// it's where the journal starts over from
+type Checkpoint struct {
+	Players    []Seat       `json:"players"`
+	Spectators []Seat       `json:"spectators,omitempty"`
+	Host       string       `json:"host,omitempty"`
+	Turn       int          `json:"turn"`
+	Visits     int          `json:"visits"`
+	Settings   RoomSettings `json:"settings"`
+}
+
+// Seat is someone who was in the room at a checkpoint
+// along with the connection they were on
+type Seat struct {
+	Player string `json:"player"`
+	Name   string `json:"name"`
+	Score  int    `json:"score,omitempty"`
+	Team   int    `json:"team,omitempty"`
+	Away   bool   `json:"away,omitempty"`
+	Visit  int    `json:"visit"`
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// summary writes down everything about the game that rebuilding should get back
+func summary(g *Game) string {
+
+	var b strings.Builder
+
+	for _, p := range g.Players.All {
+		fmt.Fprintln(&b, "player", p.ID, p.Name, p.Score, p.Team, p.Away)
+	}
+	for _, c := range g.Spectators {
+		fmt.Fprintln(&b, "spectator", c.ID)
+	}
+	if g.Host != nil {
+		fmt.Fprintln(&b, "host", g.Host.ID)
+	}
+	if g.Presenter != nil {
+		fmt.Fprintln(&b, "presenter", g.Presenter.ID)
+	}
+	if g.CurrentNoun != nil {
+		fmt.Fprintln(&b, "noun", g.CurrentNoun.Text)
+	}
+	fmt.Fprintln(&b, "started", g.IsStarted, g.StartedAt.UnixNano(), "round", g.Round, "turn", g.Players.Current)
+	fmt.Fprintln(&b, "bowl", g.Nouns.Current, g.Nouns.All, g.Nouns.Guessed)
+	fmt.Fprintln(&b, "settings", g.Room.Settings)
+	for _, played := range g.Played {
+		fmt.Fprintln(&b, "played", played.Round, played.Noun.Text, played.Presenter, played.Guesser, played.GuessedAt.UnixNano())
+	}
+	for _, guess := range g.Guesses {
+		fmt.Fprintln(&b, "guess", guess.Player, guess.Text, guess.IsCorrect)
+	}
+	for _, hint := range g.Hints {
+		fmt.Fprintln(&b, "hint", hint.Text)
+	}
+
+	return b.String()
+}
+
+// rebuild plays the journal back into a fresh room
+func rebuild(t *testing.T, seed int64, journal []Entry) *Game {
+
+	g := buildRoom(newCode(), false).CurrGame
+	g.Reseed(seed)
+
+	if err := g.Rebuild(journal); err != nil {
+		t.Fatal("Error rebuilding game", err)
+	}
+	return g
+}
+
+func TestRebuildMatchesLiveGame(t *testing.T) {
+
+	room := buildRoom(newCode(), false)
+	g := room.CurrGame
+
+	ann := &Client{UserID: "ann", ID: PlayerID("ann"), Name: "Ann"}
+	bob := &Client{UserID: "bob", ID: PlayerID("bob"), Name: "Bob"}
+	watcher := &Client{UserID: "watcher", ID: PlayerID("watcher"), Name: "Watcher", Spectator: true}
+
+	for _, c := range []*Client{ann, bob, watcher} {
+		g.Join(c)
+	}
+
+	settings := room.Settings
+	settings.Teams = 2
+	g.Do(ChangeSettings{Settings: settings, client: ann})
+
+	g.Do(Submission{Nouns: []Noun{{Person, "houdini"}, {Place, "narnia"}, {Thing, "kazoo"}}, client: ann})
+	g.Do(Submission{Nouns: []Noun{{Person, "zorro"}, {Place, "atlantis"}, {Thing, "yoyo"}}, client: bob})
+	g.Do(Start{})
+
+	guesser := func() *Client {
+		if g.Presenter.ID == ann.ID {
+			return bob
+		}
+		return ann
+	}
+
+	g.Do(Message{Text: "a hint", client: g.Presenter.Client})
+	g.Do(Message{Text: "wrong", client: guesser()})
+	g.Do(Pass{client: g.Presenter.Client})
+	g.Do(Message{Text: g.CurrentNoun.Text, client: guesser()})
+
+	// bob comes back on a new connection partway through
+	g.Leave(bob)
+	bob = &Client{UserID: "bob", ID: PlayerID("bob"), Name: "Bob"}
+	g.Join(bob)
+	g.Leave(watcher)
+
+	g.Do(Message{Text: g.CurrentNoun.Text, client: guesser()})
+
+	rebuilt := rebuild(t, g.Seed, g.Journal)
+
+	if live, again := summary(g), summary(rebuilt); live != again {
+		t.Error("Expected", live, "got", again)
+	}
+	if len(rebuilt.Journal) != len(g.Journal) {
+		t.Error("Expected", len(g.Journal), "got", len(rebuilt.Journal))
+	}
+}
+
+func TestFinishedGamesCompactJournal(t *testing.T) {
+
+	room := playThrough(t, 1, 2)
+	g := room.CurrGame
+
+	if len(g.Journal) != 1 || g.Journal[0].Kind != CheckpointEntry {
+		t.Fatal("Expected", "just a checkpoint", "got", g.Journal)
+	}
+
+	// the next game carries on from the checkpoint
+	ann, bob := g.Players.All[0].Client, g.Players.All[1].Client
+	g.Do(Submission{Nouns: []Noun{{Person, "houdini"}, {Place, "narnia"}, {Thing, "kazoo"}}, client: ann})
+	g.Do(Submission{Nouns: []Noun{{Person, "zorro"}, {Place, "atlantis"}, {Thing, "yoyo"}}, client: bob})
+	g.Do(Start{})
+
+	guesser := ann
+	if g.Presenter.Client == ann {
+		guesser = bob
+	}
+	g.Do(Message{Text: g.CurrentNoun.Text, client: guesser})
+	g.Leave(guesser)
+
+	rebuilt := rebuild(t, g.Seed, g.Journal)
+
+	if live, again := summary(g), summary(rebuilt); live != again {
+		t.Error("Expected", live, "got", again)
+	}
+	if len(rebuilt.Journal) != len(g.Journal) {
+		t.Error("Expected", len(g.Journal), "got", len(rebuilt.Journal))
+	}
+}
+
+func TestRebuildRejectsBrokenJournals(t *testing.T) {
+
+	broken := [][]Entry{
+		{{Kind: MessageEntry, Visit: 4, Body: json.RawMessage(`"hello"`)}},
+		{{Kind: JoinEntry, Player: PlayerID("ann"), Name: "Ann"}, {Kind: SubmitEntry, Visit: 1, Body: json.RawMessage(`"nope"`)}},
+		{{Kind: "dance"}},
+	}
+
+	for _, journal := range broken {
+
+		g := buildRoom(newCode(), false).CurrGame
+		if err := g.Rebuild(journal); err == nil {
+			t.Error("Expected", "an error", "got", journal)
+		}
+	}
+}
+
+// capturedGames are what the games in testdata/games should end up as
+var capturedGames = map[string]struct {
+	round     int
+	presenter string
+	noun      string
+	scores    map[string]int
+	played    int
+	guesses   []bool
+}{
+	"three-players.json": {
+		round:     2,
+		presenter: "Bob",
+		noun:      "Rubber Duck",
+		scores:    map[string]int{"Ann": 3, "Bob": 9, "Cat": 10},
+		played:    11,
+		guesses:   []bool{false, true, true, true, false, true, false, false, true, true},
+	},
+}
+
+func TestCapturedGamesReplay(t *testing.T) {
+
+	files, err := filepath.Glob(filepath.Join("testdata", "games", "*.json"))
+	if err != nil || len(files) == 0 {
+		t.Fatal("Expected", "captured games", "got", files, err)
+	}
+
+	for _, file := range files {
+
+		expected, ok := capturedGames[filepath.Base(file)]
+		if !ok {
+			t.Error("Expected", "results for", file, "got", "nothing")
+			continue
+		}
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal("Error reading", file, err)
+		}
+
+		captured := struct {
+			Seed    int64   `json:"seed"`
+			Journal []Entry `json:"journal"`
+		}{}
+		if err := json.Unmarshal(data, &captured); err != nil {
+			t.Fatal("Error reading", file, err)
+		}
+
+		g := rebuild(t, captured.Seed, captured.Journal)
+
+		if g.Round != expected.round || g.Presenter.Name != expected.presenter || g.CurrentNoun.Text != expected.noun {
+			t.Error(file, "Expected", expected.round, expected.presenter, expected.noun,
+				"got", g.Round, g.Presenter.Name, g.CurrentNoun.Text)
+		}
+
+		for _, p := range g.Players.All {
+			if p.Score != expected.scores[p.Name] {
+				t.Error(file, "Expected", p.Name, expected.scores[p.Name], "got", p.Score)
+			}
+		}
+
+		if len(g.Played) != expected.played {
+			t.Error(file, "Expected", expected.played, "got", len(g.Played))
+		}
+
+		// every guess has to be judged the same way it was when it was captured
+		if len(g.Guesses) != len(expected.guesses) {
+			t.Fatal(file, "Expected", len(expected.guesses), "got", len(g.Guesses))
+		}
+		for i, guess := range g.Guesses {
+			if guess.IsCorrect != expected.guesses[i] {
+				t.Error(file, "Expected", guess.Text, "to be", expected.guesses[i], "got", guess.IsCorrect)
+			}
+		}
+
+		// and the same journal always builds the same game
+		if again := rebuild(t, captured.Seed, captured.Journal); summary(again) != summary(g) {
+			t.Error(file, "Expected", summary(g), "got", summary(again))
+		}
+	}
+}
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"html/template"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"path"
 	"runtime"
 	"strconv"
-	"text/template"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -19,6 +27,29 @@ import (
 //***********************************************************************************************
 
 var addr = flag.String("addr", ":8080", "http service address")
+var roomIdle = flag.Duration("room-idle", 10*time.Minute, "how long an empty room stays open before closing")
+var relayWait = flag.Duration("relay-wait", 10*time.Second, "how long a guest waits on another instance to let them in to its room")
+var maxPlayers = flag.Int("max-players", 12, "most players a room can seat")
+var maxSpectators = flag.Int("max-spectators", 20, "most spectators a room can hold")
+var sendQueue = flag.Int("send-queue", 64, "how many outgoing messages can queue up for each client")
+var overflow = flag.String("overflow", string(DropOldest), "what to do when a client's queue is full: drop-oldest, coalesce or disconnect")
+var pingPeriod = flag.Duration("ping-period", 54*time.Second, "how often to ping each client, must be less than pong-wait")
+var pongWait = flag.Duration("pong-wait", 60*time.Second, "how long to wait on a client before dropping their connection")
+var writeWait = flag.Duration("write-wait", 10*time.Second, "how long a single write to a client may take")
+var maxMessageSize = flag.Int64("max-message", 4096, "largest message in bytes a client may send")
+var storePath = flag.String("store", "nouns.json", "file the rooms are saved to so they survive a restart, leave blank to turn off")
+var saveEvery = flag.Duration("save-every", 15*time.Second, "how often the rooms get saved")
+var historyPath = flag.String("history", "history.jsonl", "file finished games are recorded in, leave blank to only keep them in memory")
+var accountsPath = flag.String("accounts", "accounts.json", "file the registered accounts are kept in, leave blank to only keep them in memory")
+var cookieKeysPath = flag.String("cookie-keys", "cookie-keys.txt", "file the keys that sign session cookies are kept in, leave blank to make a new key every start")
+var rotateEvery = flag.Duration("rotate-keys", 24*time.Hour, "how often a new key starts signing session cookies, 0 to never rotate")
+var sessionIdle = flag.Duration("session-idle", 3*time.Hour, "how long a session can go without a message before it expires")
+var sessionSweep = flag.Duration("session-sweep", 30*time.Second, "how often expired sessions get removed")
+var redisAddr = flag.String("redis", "", "address of a redis to share rooms with other instances through, leave blank to run on its own")
+var replayDir = flag.String("replays", "replays", "folder the event logs of finished games are kept in, leave blank to only keep them in memory")
+
+// Parsed from the overflow flag
+var overflowPolicy = DropOldest
 
 var tpl *template.Template
 
@@ -37,20 +68,154 @@ func main() {
 
 	flag.Parse()
 
+	policy, err := ParseOverflowPolicy(*overflow)
+	if err != nil {
+		log.Fatalln("Error reading flags", err)
+	}
+	overflowPolicy = policy
+
+	if *pingPeriod >= *pongWait {
+		log.Fatalln("Error reading flags, ping-period must be less than pong-wait")
+	}
+
+	if *cookieKeysPath != "" {
+
+		if err := cookieKeys.Open(*cookieKeysPath); err != nil {
+			log.Fatalln("Error opening cookie keys", err)
+		}
+	}
+
+	// instances sharing a redis share the rooms and the keys cookies are signed with
+	if *redisAddr != "" {
+
+		shared, err := NewRedisBackend(*redisAddr)
+		if err != nil {
+			log.Fatalln("Error connecting to redis", err)
+		}
+		backend = shared
+
+		if err := cookieKeys.Share(backend); err != nil {
+			log.Fatalln("Error sharing cookie keys", err)
+		}
+		if err := directory.Follow(backend); err != nil {
+			log.Fatalln("Error following the lobby", err)
+		}
+		log.Println("Sharing rooms through redis at", *redisAddr, "as instance", instanceID)
+	}
+
+	if *rotateEvery > 0 {
+		go rotateKeys(cookieKeys, *rotateEvery)
+	}
+
+	// pick up any games that were going before the last restart
+	if *storePath != "" {
+
+		store := NewFileStore(*storePath)
+
+		restored, err := RestoreRooms(store)
+		if err != nil {
+			log.Fatalln("Error restoring rooms", err)
+		}
+		log.Println("Restored", restored, "rooms from", *storePath)
+
+		go keep(store, *saveEvery)
+	}
+
+	if *historyPath != "" {
+
+		if err := history.Open(*historyPath); err != nil {
+			log.Fatalln("Error opening history", err)
+		}
+	}
+
+	if *accountsPath != "" {
+
+		if err := accounts.Open(*accountsPath); err != nil {
+			log.Fatalln("Error opening accounts", err)
+		}
+	}
+
+	if *replayDir != "" {
+
+		if err := replays.Open(*replayDir); err != nil {
+			log.Fatalln("Error opening replays", err)
+		}
+	}
+
 	mux := http.NewServeMux()
 
 	// route handlers
 	mux.HandleFunc("/", index)
 	mux.HandleFunc("/favicon.ico", faviconHandler)
-	mux.HandleFunc("/ws/", socketHandler)
+	mux.HandleFunc("/ws/", RequireSession(socketHandler, refuseSocket))
 	mux.HandleFunc("/404", notfoundHandler)
 	mux.HandleFunc("/admin", adminHandler)
 	mux.HandleFunc("/join", joinHandler)
-	mux.HandleFunc("/room/", roomHandler)
+	mux.HandleFunc("/room/", RequireSession(roomHandler, sendToJoin))
+	mux.HandleFunc("/lobby", lobbyHandler)
+	mux.HandleFunc("/lobby/rooms", lobbyRoomsHandler)
+	mux.HandleFunc("/lobby/ws", lobbySocketHandler)
+	mux.HandleFunc("/history", historyHandler)
+	mux.HandleFunc("/history/", matchHandler)
+	mux.HandleFunc("/history/games", historyGamesHandler)
+	mux.HandleFunc("/history/games/", matchGameHandler)
+	mux.HandleFunc("/account", accountHandler)
+	mux.HandleFunc("/account/register", registerHandler)
+	mux.HandleFunc("/account/signin", signInHandler)
+	mux.HandleFunc("/account/signout", signOutHandler)
+	mux.HandleFunc("/leaderboard", leaderboardHandler)
+	mux.HandleFunc("/replay/", replayHandler)
+	mux.HandleFunc("/replay/ws/", replaySocketHandler)
 
 	// serves all the static resources for js and css
 	mux.Handle("/resource/", http.StripPrefix("/resource/", http.FileServer(http.Dir("static"))))
-	log.Fatal(http.ListenAndServe(*addr, mux))
+
+	sessions.Start(*sessionSweep, *sessionIdle)
+
+	server := &http.Server{Addr: *addr, Handler: WithSession(mux)}
+	stopped := make(chan struct{})
+	go shutdownOnExit(server, stopped)
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+}
+
+// shutdownOnExit stops the server cleanly when it's told to stop
+// the rooms get saved one last time and given up to the other instances
+// and the session worker is stopped
+func shutdownOnExit(server *http.Server, stopped chan struct{}) {
+
+	defer close(stopped)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	log.Println("Shutting down..")
+
+	// stop taking new requests and let the ones going finish up
+	ctx, cancel := context.WithTimeout(context.Background(), *writeWait)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Error shutting down server", err)
+	}
+
+	if *storePath != "" {
+
+		log.Println("Saving rooms before shutting down..")
+		if err := SaveRooms(NewFileStore(*storePath)); err != nil {
+			log.Println("Error saving rooms", err)
+		}
+	}
+
+	releaseRooms()
+	if err := backend.Close(); err != nil {
+		log.Println("Error closing backend", err)
+	}
+
+	sessions.Close()
 }
 
 //***********************************************************************************************
@@ -86,15 +251,23 @@ func adminHandler(res http.ResponseWriter, req *http.Request) {
 	}
 
 	adminData := struct {
-		Routines int
-		Cpus     int
-		Rooms    int
-		Sessions int
+		Routines     int
+		Cpus         int
+		Rooms        int
+		ClosedRooms  int64
+		Sessions     int
+		Dropped      int64
+		Coalesced    int64
+		Disconnected int64
 	}{
 		runtime.NumGoroutine(),
 		runtime.NumCPU(),
-		len(hotel),
-		len(sessions),
+		hotel.Len(),
+		atomic.LoadInt64(&closedRooms),
+		sessions.Len(),
+		atomic.LoadInt64(&outboxStats.Dropped),
+		atomic.LoadInt64(&outboxStats.Coalesced),
+		atomic.LoadInt64(&outboxStats.Disconnected),
 	}
 
 	tpl.ExecuteTemplate(res, "admin.html", adminData)
@@ -111,14 +284,42 @@ func joinHandler(res http.ResponseWriter, req *http.Request) {
 			http.Error(res, "Oh poop, something went wrong reading your request.", http.StatusBadRequest)
 		}
 
-		AddCookies(res, req)
-		roomPath := GenerateRoomPath(req.Form)
+		// turn them away now rather than once the room page loads
+		spectator := req.Form.Get("spectator") != ""
+		roomID := NormalizeCode(req.Form.Get("room"))
+		if room, ok := GetRoom(roomID); ok && !room.HasSpace(spectator) {
+
+			renderJoin(res, req, fmt.Sprintf("Room %v is full.", roomID), "")
+			return
+		}
+
+		uid := AddCookies(res, req)
+		roomPath, err := GenerateRoomPath(req.Form, uid)
+		if err == ErrNoSuchRoom && validCode(roomID) {
+
+			// maybe they meant to make a room with that name
+			renderJoin(res, req, err.Error(), roomID)
+			return
+
+		} else if err != nil {
+
+			renderJoin(res, req, err.Error(), "")
+			return
+		}
 
 		http.Redirect(res, req, roomPath, http.StatusSeeOther)
 
 	} else if req.Method == http.MethodGet {
 
-		tpl.ExecuteTemplate(res, "join.html", nil)
+		// the room page sends people back here when the room is full
+		message := ""
+		if full := req.URL.Query().Get("full"); full != "" {
+			message = fmt.Sprintf("Room %v is full.", full)
+		}
+
+		// the lobby links here with the room filled in
+		req.ParseForm()
+		renderJoin(res, req, message, "")
 
 	} else {
 
@@ -128,29 +329,363 @@ func joinHandler(res http.ResponseWriter, req *http.Request) {
 	return
 }
 
-// Handles the room page
-func roomHandler(res http.ResponseWriter, req *http.Request) {
+// renderJoin shows the join page with an optional error
+// and an offer to create a room under the name they typed
+// anything they already filled in is kept
+func renderJoin(res http.ResponseWriter, req *http.Request, message string, offer string) {
 
-	_, isActive := ActiveSession(res, req)
+	joinData := struct {
+		Error     string
+		Offer     string
+		Guestname string
+		Room      string
+	}{
+		message,
+		offer,
+		req.Form.Get("guestname"),
+		req.Form.Get("room"),
+	}
 
-	if !isActive {
+	// signed in players go by their username unless they say otherwise
+	if visitor, ok := VisitorFrom(req); ok && joinData.Guestname == "" {
+		joinData.Guestname, _ = accounts.SignedIn(visitor.UserID)
+	}
 
-		http.Redirect(res, req, "/join", http.StatusSeeOther)
+	tpl.ExecuteTemplate(res, "join.html", joinData)
+}
 
-	} else if req.Method == http.MethodGet {
+// Handles the lobby page
+func lobbyHandler(res http.ResponseWriter, req *http.Request) {
+
+	if req.Method != http.MethodGet {
+
+		http.Redirect(res, req, "/404", http.StatusSeeOther)
+		return
+	}
+
+	tpl.ExecuteTemplate(res, "lobby.html", directory.Listings())
+}
+
+// Handles the list of public rooms as json
+func lobbyRoomsHandler(res http.ResponseWriter, req *http.Request) {
+
+	if req.Method != http.MethodGet {
+
+		http.Error(res, "Only GET is supported here.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(res, directory.Listings())
+}
+
+// Handles the lobby websocket which keeps the list of public rooms up to date
+func lobbySocketHandler(res http.ResponseWriter, req *http.Request) {
+
+	conn, err := upgrader.Upgrade(res, req, nil)
+
+	if err != nil {
+
+		log.Println("Error upgrading lobby conn to socket", err)
+		return
+	}
+
+	directory.Serve(conn)
+}
+
+// Handles the history page
+// the games can be narrowed down to a room or a player
+func historyHandler(res http.ResponseWriter, req *http.Request) {
+
+	if req.Method != http.MethodGet {
+
+		http.Redirect(res, req, "/404", http.StatusSeeOther)
+		return
+	}
+
+	room, player := historyFilter(req)
+
+	historyData := struct {
+		Room    string
+		Player  string
+		Matches []MatchRecord
+	}{
+		room,
+		player,
+		history.Find(room, player),
+	}
+
+	tpl.ExecuteTemplate(res, "history.html", historyData)
+}
+
+// Handles the page for a single finished game
+func matchHandler(res http.ResponseWriter, req *http.Request) {
+
+	match, ok := history.Get(path.Base(req.URL.Path))
+	if !ok || req.Method != http.MethodGet {
+
+		http.Redirect(res, req, "/404", http.StatusSeeOther)
+		return
+	}
+
+	tpl.ExecuteTemplate(res, "match.html", match)
+}
+
+// Handles the list of finished games as json
+func historyGamesHandler(res http.ResponseWriter, req *http.Request) {
+
+	if req.Method != http.MethodGet {
+
+		http.Error(res, "Only GET is supported here.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	room, player := historyFilter(req)
+	writeJSON(res, history.Find(room, player))
+}
+
+// Handles a single finished game as json
+func matchGameHandler(res http.ResponseWriter, req *http.Request) {
+
+	if req.Method != http.MethodGet {
+
+		http.Error(res, "Only GET is supported here.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	match, ok := history.Get(path.Base(req.URL.Path))
+	if !ok {
+
+		http.Error(res, "We couldn't find that game.", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(res, match)
+}
+
+// Handles the account page which is either the sign in forms
+// or the signed in player's lifetime stats
+func accountHandler(res http.ResponseWriter, req *http.Request) {
+
+	if req.Method != http.MethodGet {
+
+		http.Redirect(res, req, "/404", http.StatusSeeOther)
+		return
+	}
+
+	renderAccount(res, req, "")
+}
+
+// Handles registering a new account
+func registerHandler(res http.ResponseWriter, req *http.Request) {
+
+	if req.Method != http.MethodPost {
+
+		http.Redirect(res, req, "/account", http.StatusSeeOther)
+		return
+	}
+
+	uid := addUserID(res, req)
+
+	err := accounts.Register(req.FormValue("username"), req.FormValue("password"), uid)
+	if err != nil {
+
+		renderAccount(res, req, err.Error())
+		return
+	}
+
+	http.Redirect(res, req, "/account", http.StatusSeeOther)
+}
+
+// Handles signing in to an account
+func signInHandler(res http.ResponseWriter, req *http.Request) {
+
+	if req.Method != http.MethodPost {
+
+		http.Redirect(res, req, "/account", http.StatusSeeOther)
+		return
+	}
+
+	uid := addUserID(res, req)
+
+	err := accounts.SignIn(req.FormValue("username"), req.FormValue("password"), uid)
+	if err != nil {
+
+		renderAccount(res, req, err.Error())
+		return
+	}
+
+	http.Redirect(res, req, "/account", http.StatusSeeOther)
+}
+
+// Handles signing out of an account
+func signOutHandler(res http.ResponseWriter, req *http.Request) {
+
+	if req.Method != http.MethodPost {
+
+		http.Redirect(res, req, "/account", http.StatusSeeOther)
+		return
+	}
+
+	if visitor, ok := VisitorFrom(req); ok {
+
+		if err := accounts.SignOut(visitor.UserID); err != nil {
+			log.Println("Error signing out", err)
+		}
+	}
+
+	http.Redirect(res, req, "/account", http.StatusSeeOther)
+}
+
+// renderAccount shows the account page with an optional error
+func renderAccount(res http.ResponseWriter, req *http.Request, message string) {
+
+	accountData := struct {
+		Error    string
+		Username string
+		SignedIn bool
+		Stats    Stats
+	}{
+		Error:    message,
+		Username: req.FormValue("username"),
+	}
+
+	if visitor, ok := VisitorFrom(req); ok && message == "" {
+
+		if username, ok := accounts.SignedIn(visitor.UserID); ok {
+			accountData.Username = username
+			accountData.SignedIn = true
+			accountData.Stats = accounts.StatsFor(username)
+		}
+	}
+
+	tpl.ExecuteTemplate(res, "account.html", accountData)
+}
+
+// Handles the leaderboard, everyone or just the players in a room
+func leaderboardHandler(res http.ResponseWriter, req *http.Request) {
+
+	if req.Method != http.MethodGet {
+
+		http.Redirect(res, req, "/404", http.StatusSeeOther)
+		return
+	}
+
+	room := NormalizeCode(req.URL.Query().Get("room"))
+
+	leaderboardData := struct {
+		Room  string
+		Board []Stats
+	}{
+		room,
+		accounts.Leaderboard(room),
+	}
+
+	tpl.ExecuteTemplate(res, "leaderboard.html", leaderboardData)
+}
+
+// Handles the page for watching a finished game again
+func replayHandler(res http.ResponseWriter, req *http.Request) {
+
+	match, ok := history.Get(path.Base(req.URL.Path))
+	if !ok || req.Method != http.MethodGet {
+
+		http.Redirect(res, req, "/404", http.StatusSeeOther)
+		return
+	}
+
+	replayData := struct {
+		ID    string
+		Match string
+	}{
+		match.Room,
+		match.ID,
+	}
+
+	tpl.ExecuteTemplate(res, "replay.html", replayData)
+}
+
+// Handles the websocket a replay is streamed down
+// the speed starts out at whatever the page asked for
+func replaySocketHandler(res http.ResponseWriter, req *http.Request) {
+
+	events, ok := replays.Get(path.Base(req.URL.Path))
+	if !ok {
+
+		http.Error(res, "We couldn't find a replay for that game.", http.StatusNotFound)
+		return
+	}
+
+	speed, err := strconv.ParseFloat(req.URL.Query().Get("speed"), 64)
+	if err != nil {
+		speed = 1
+	}
+
+	conn, err := upgrader.Upgrade(res, req, nil)
+	if err != nil {
+
+		log.Println("Error upgrading replay conn to socket", err)
+		return
+	}
+
+	Replay(conn, events, speed)
+}
+
+// historyFilter reads which room and player the history is being narrowed to
+// a raw uid gets hashed the same way the history does and
+// asking for your own games goes off the session cookie
+func historyFilter(req *http.Request) (string, string) {
+
+	query := req.URL.Query()
+
+	room := NormalizeCode(query.Get("room"))
+	player := query.Get("player")
+	if uid := query.Get("uid"); uid != "" {
+		player = PlayerID(uid)
+	}
+	if visitor, ok := VisitorFrom(req); ok && query.Get("mine") != "" {
+		player = PlayerID(visitor.UserID)
+	}
+
+	return room, player
+}
+
+// writeJSON sends the value back as json
+func writeJSON(res http.ResponseWriter, v interface{}) {
+
+	res.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(res).Encode(v)
+	if err != nil {
+		log.Println("Error writing json", err)
+	}
+}
+
+// Handles the room page
+// only visitors with a session get this far
+func roomHandler(res http.ResponseWriter, req *http.Request) {
+
+	visitor, _ := VisitorFrom(req)
+
+	if req.Method == http.MethodGet {
 
 		roomPath := path.Base(req.URL.Path)
-		roomID, _ := strconv.ParseInt(roomPath, 10, 64)
 
 		log.Println(req.Method, "to join", roomPath)
 
-		room, ok := GetRoom(roomID)
+		room, ok := GetRoom(roomPath)
 		if !ok {
 
 			http.Redirect(res, req, "/404", http.StatusSeeOther)
 			return
 		}
 
+		// private rooms need the password from the join page first
+		if !room.Invited(visitor.UserID) {
+
+			http.Redirect(res, req, "/join", http.StatusSeeOther)
+			return
+		}
+
 		tpl.ExecuteTemplate(res, "room.html", room)
 
 	} else {
@@ -170,10 +705,10 @@ var upgrader = websocket.Upgrader{
 }
 
 // Handles incoming websockets requests
+// only visitors with a session get this far
 func socketHandler(res http.ResponseWriter, req *http.Request) {
 
 	roomPath := path.Base(req.URL.String())
-	roomID, _ := strconv.ParseInt(roomPath, 10, 64)
 	log.Println("Socket attempt to connect to room", roomPath)
 
 	// upgrade the req to a websocket
@@ -185,9 +720,9 @@ func socketHandler(res http.ResponseWriter, req *http.Request) {
 		http.Error(res, "Uh oh, there was an issue connecting to the host.", http.StatusBadRequest)
 		return
 	}
-	log.Println("Client upgraded to websocket in room", roomID)
+	log.Println("Client upgraded to websocket in room", roomPath)
 
-	room, ok := GetRoom(roomID)
+	room, ok := GetRoom(roomPath)
 	if !ok {
 
 		log.Println("Socket error finding room", roomPath)
@@ -201,8 +736,20 @@ func socketHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	visitor, _ := VisitorFrom(req)
+	if !room.Invited(visitor.UserID) {
+
+		log.Println("Socket turned away from private room", roomPath)
+
+		conn.WriteMessage(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "This room is private, join it with the password first."))
+
+		conn.Close()
+
+		return
+	}
+
 	// create the new client
-	uid, _ := ActiveSession(res, req)
-	guestName := GetGuestName(res, req)
-	NewClient(uid, guestName, room, conn)
+	NewClient(visitor.UserID, visitor.Name, visitor.Spectator, room, conn)
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+// The key a visitor is kept under in the request's context
+type contextKey int
+
+const visitorKey contextKey = 0
+
+//***********************************************************************************************
+//
+// External
+//
+//***********************************************************************************************
+
+// WithSession works out who's visiting from their signed cookies
+// and puts them in the request's context for the handlers further down
+// a visitor without a session still gets through, just without one
+func WithSession(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+
+		if visitor, ok := readVisitor(req); ok {
+			req = req.WithContext(context.WithValue(req.Context(), visitorKey, visitor))
+		}
+		next.ServeHTTP(res, req)
+	})
+}
+
+// RequireSession only lets visitors with a session through to the handler
+// anyone else is handed to missing instead
+func RequireSession(next http.HandlerFunc, missing http.HandlerFunc) http.HandlerFunc {
+
+	return func(res http.ResponseWriter, req *http.Request) {
+
+		// the session may not have been read yet if this isn't behind WithSession
+		if _, ok := VisitorFrom(req); !ok {
+
+			visitor, ok := readVisitor(req)
+			if !ok {
+
+				missing(res, req)
+				return
+			}
+			req = req.WithContext(context.WithValue(req.Context(), visitorKey, visitor))
+		}
+
+		next(res, req)
+	}
+}
+
+// VisitorFrom gets the visitor the middleware put in the request
+func VisitorFrom(req *http.Request) (Visitor, bool) {
+
+	visitor, ok := req.Context().Value(visitorKey).(Visitor)
+	return visitor, ok
+}
+
+//***********************************************************************************************
+//
+// Internal
+//
+//***********************************************************************************************
+
+// readVisitor reads the session out of the signed cookies
+// there's only a session if the uid checks out and the
+// server still has it, reading it counts as activity
+func readVisitor(req *http.Request) (Visitor, bool) {
+
+	uid, err := ReadSigned(req, "uid")
+	if err == ErrBadSignature {
+		log.Println("Error reading cookie for uid", err)
+	}
+	if err != nil {
+		return Visitor{}, false
+	}
+
+	if !sessions.Active(uid) {
+		log.Println("Session has expired for a visitor")
+		return Visitor{}, false
+	}
+
+	visitor := Visitor{UserID: uid, Name: "annonymous"}
+
+	if name, err := ReadSigned(req, "guestname"); err == nil {
+		visitor.Name = name
+	}
+	if spectator, err := ReadSigned(req, "spectator"); err == nil {
+		visitor.Spectator = spectator == "true"
+	}
+
+	return visitor, true
+}
+
+// sendToJoin sends pages without a session to the join page to get one
+func sendToJoin(res http.ResponseWriter, req *http.Request) {
+
+	http.Redirect(res, req, "/join", http.StatusSeeOther)
+}
+
+// refuseSocket turns away sockets without a session before they're upgraded
+func refuseSocket(res http.ResponseWriter, req *http.Request) {
+
+	log.Println("Socket turned away without a session", req.URL.Path)
+	http.Error(res, "Join the room from the join page first.", http.StatusUnauthorized)
+}
+
+//***********************************************************************************************
+//
+// Structs
+//
+//***********************************************************************************************
+
+// Visitor is who a request came from going by their session cookies
+type Visitor struct {
+	UserID    string
+	Name      string
+	Spectator bool
+}
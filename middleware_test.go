@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestFreshBrowserWithoutSession(t *testing.T) {
+
+	room := CreateRoom("", false)
+
+	// visiting a room link straight away
+	res := httptest.NewRecorder()
+	RequireSession(roomHandler, sendToJoin)(res, httptest.NewRequest(http.MethodGet, "/room/"+room.ID, nil))
+
+	if res.Code != http.StatusSeeOther || res.Header().Get("Location") != "/join" {
+		t.Error("Expected", "a redirect to /join", "got", res.Code, res.Header().Get("Location"))
+	}
+
+	// opening the socket without ever joining
+	server := httptest.NewServer(RequireSession(socketHandler, refuseSocket))
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/" + room.ID
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		conn.Close()
+		t.Fatal("Expected", "the socket to be refused", "got", "a connection")
+	}
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected", http.StatusUnauthorized, "got", resp)
+	}
+}
+
+func TestSessionInContext(t *testing.T) {
+
+	var visitor Visitor
+	var ok bool
+	handler := WithSession(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		visitor, ok = VisitorFrom(req)
+	}))
+
+	// no cookies still gets through, just without a visitor
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if ok {
+		t.Error("Expected", "no visitor", "got", visitor)
+	}
+
+	sessions.Open("context-uid")
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "uid", Value: cookieKeys.sign("uid", "context-uid")})
+	req.AddCookie(&http.Cookie{Name: "guestname", Value: cookieKeys.sign("guestname", "Ann")})
+	req.AddCookie(&http.Cookie{Name: "spectator", Value: cookieKeys.sign("spectator", "true")})
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !ok || visitor != (Visitor{UserID: "context-uid", Name: "Ann", Spectator: true}) {
+		t.Error("Expected", "Ann watching as context-uid", "got", visitor, ok)
+	}
+
+	// a name without a session isn't a session
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "guestname", Value: cookieKeys.sign("guestname", "Ann")})
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if ok {
+		t.Error("Expected", "no visitor", "got", visitor)
+	}
+}
+
+func TestExpiredSessionIsTurnedAway(t *testing.T) {
+
+	room := CreateRoom("", false)
+	uid := "expired-" + room.ID
+
+	visit := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/room/"+room.ID, nil)
+		req.AddCookie(&http.Cookie{Name: "uid", Value: cookieKeys.sign("uid", uid)})
+		res := httptest.NewRecorder()
+		RequireSession(roomHandler, sendToJoin)(res, req)
+		return res.Code
+	}
+
+	// the cookie is still signed but the server let the session go
+	sessions.Open(uid)
+	sessions.Delete(uid)
+	backend.Delete(sessionKey(uid))
+
+	if code := visit(); code != http.StatusSeeOther {
+		t.Error("Expected", http.StatusSeeOther, "got", code)
+	}
+
+	// a session another instance still has counts
+	backend.Set(sessionKey(uid), "true", time.Minute)
+
+	if code := visit(); code != http.StatusOK {
+		t.Error("Expected", http.StatusOK, "got", code)
+	}
+	if _, ok := sessions.Get(uid); !ok {
+		t.Error("Expected", "the session to be picked up here", "got", "nothing")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+//***********************************************************************************************
+//
+// Enums
+//
+//***********************************************************************************************
+
+// OverflowPolicy decides what happens when
+// a clients outbox is full and another message arrives
+type OverflowPolicy string
+
+const (
+	DropOldest OverflowPolicy = "drop-oldest"
+	Coalesce   OverflowPolicy = "coalesce"
+	Disconnect OverflowPolicy = "disconnect"
+)
+
+// Counts what the outboxes have had to throw away
+var outboxStats struct {
+	Dropped      int64
+	Coalesced    int64
+	Disconnected int64
+}
+
+//***********************************************************************************************
+//
+// External
+//
+//***********************************************************************************************
+
+// ParseOverflowPolicy checks that the policy is one we know how to handle
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+
+	switch p := OverflowPolicy(s); p {
+	case DropOldest, Coalesce, Disconnect:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown overflow policy %q", s)
+}
+
+// NewOutbox builds an outbox that holds up to size messages
+func NewOutbox(size int, policy OverflowPolicy) *Outbox {
+
+	if size < 1 {
+		size = 1
+	}
+
+	return &Outbox{
+		size:   size,
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// Push queues up a message without blocking
+// it returns false if the client is too far behind and should be disconnected
+func (o *Outbox) Push(message interface{}) bool {
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return false
+	}
+
+	if len(o.items) >= o.size {
+
+		switch o.policy {
+
+		case DropOldest:
+			o.items = o.items[1:]
+			atomic.AddInt64(&outboxStats.Dropped, 1)
+
+		case Coalesce:
+			o.items = coalesce(o.items, message)
+
+		default:
+			atomic.AddInt64(&outboxStats.Disconnected, 1)
+			return false
+		}
+	}
+
+	o.items = append(o.items, message)
+	o.signal()
+
+	return true
+}
+
+// Drain hands back everything queued up so far
+// and whether the outbox is still open
+func (o *Outbox) Drain() ([]interface{}, bool) {
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	items := o.items
+	o.items = nil
+
+	return items, !o.closed
+}
+
+// Ready fires whenever there are messages to drain or the outbox closes
+func (o *Outbox) Ready() <-chan struct{} {
+
+	return o.ready
+}
+
+// Close stops the outbox from taking any more messages
+// it is safe to call more than once
+func (o *Outbox) Close() {
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return
+	}
+
+	o.closed = true
+	o.signal()
+}
+
+//***********************************************************************************************
+//
+// Internal
+//
+//***********************************************************************************************
+
+// signal wakes up the writer if it isn't already awake
+func (o *Outbox) signal() {
+
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// coalesce makes room for the message by replacing the oldest queued
+// message of the same kind, since the newer one supersedes it
+// if there isn't one the oldest message gets dropped instead
+func coalesce(items []interface{}, message interface{}) []interface{} {
+
+	kind := kindOf(message)
+
+	for i, item := range items {
+		if kindOf(item) == kind {
+
+			atomic.AddInt64(&outboxStats.Coalesced, 1)
+			return append(items[:i], items[i+1:]...)
+		}
+	}
+
+	log.Println("Nothing to coalesce, dropping the oldest message")
+	atomic.AddInt64(&outboxStats.Dropped, 1)
+
+	return items[1:]
+}
+
+// kindOf is what a message gets coalesced by
+// relayed envelopes go by their type since they're all the same struct
+func kindOf(message interface{}) interface{} {
+
+	if env, ok := message.(Envelope); ok {
+		return env.Type
+	}
+	return reflect.TypeOf(message)
+}
+
+//***********************************************************************************************
+//
+// Structs
+//
+//***********************************************************************************************
+
+// Outbox is a clients queue of outgoing messages
+// the room pushes to it and the clients writer drains it
+type Outbox struct {
+	mu     sync.Mutex
+	items  []interface{}
+	size   int
+	policy OverflowPolicy
+	ready  chan struct{}
+	closed bool
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestOutboxDropOldest(t *testing.T) {
+
+	o := NewOutbox(2, DropOldest)
+
+	o.Push(&Guess{Text: "one"})
+	o.Push(&Guess{Text: "two"})
+
+	if !o.Push(&Guess{Text: "three"}) {
+		t.Fatal("Expected", "push to succeed", "got", false)
+	}
+
+	items, open := o.Drain()
+	if !open || len(items) != 2 {
+		t.Fatal("Expected", "2 open items", "got", len(items), open)
+	}
+	if items[0].(*Guess).Text != "two" {
+		t.Error("Expected", "two", "got", items[0].(*Guess).Text)
+	}
+}
+
+func TestOutboxCoalesce(t *testing.T) {
+
+	o := NewOutbox(3, Coalesce)
+
+	o.Push(&Noun{Person, "dumbledore"})
+	o.Push(&Guess{Text: "one"})
+	o.Push(&Guess{Text: "two"})
+	o.Push(&Noun{Place, "hogwarts"})
+
+	items, _ := o.Drain()
+	if len(items) != 3 {
+		t.Fatal("Expected", "3 items", "got", len(items))
+	}
+	if items[2].(*Noun).Text != "hogwarts" {
+		t.Error("Expected", "hogwarts", "got", items[2])
+	}
+	if items[0].(*Guess).Text != "one" {
+		t.Error("Expected", "one", "got", items[0])
+	}
+}
+
+func TestOutboxDisconnect(t *testing.T) {
+
+	o := NewOutbox(1, Disconnect)
+
+	o.Push(&Guess{Text: "one"})
+
+	if o.Push(&Guess{Text: "two"}) {
+		t.Error("Expected", "push to fail", "got", true)
+	}
+}
+
+func TestOutboxClose(t *testing.T) {
+
+	o := NewOutbox(1, DropOldest)
+
+	o.Close()
+	o.Close()
+
+	if o.Push(&Guess{Text: "one"}) {
+		t.Error("Expected", "push to fail", "got", true)
+	}
+
+	if _, open := o.Drain(); open {
+		t.Error("Expected", "closed", "got", open)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Only touches the key if it still holds the value
+// so an instance never clobbers a claim someone else took over
+var (
+	refreshScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`)
+
+	releaseScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+)
+
+//***********************************************************************************************
+//
+// External
+//
+//***********************************************************************************************
+
+// NewRedisBackend connects to a redis, or anything that speaks its protocol
+// the address can be host:port or a redis:// url
+func NewRedisBackend(addr string) (*RedisBackend, error) {
+
+	options, err := redis.ParseURL(addr)
+	if err != nil {
+		options = &redis.Options{Addr: addr}
+	}
+
+	client := redis.NewClient(options)
+
+	// make sure it's really there before anything gets relayed through it
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	// every pubsub holds a connection of its own so the instance only
+	// has the one and hands out what it hears to the rooms listening here
+	// it waits for redis to confirm so nothing published afterwards is missed
+	pubsub := client.PSubscribe(context.Background(), backendPrefix+"*")
+	if _, err := pubsub.Receive(context.Background()); err != nil {
+		pubsub.Close()
+		client.Close()
+		return nil, err
+	}
+
+	r := &RedisBackend{
+		client:     client,
+		pubsub:     pubsub,
+		local:      NewMemoryBackend(),
+		dispatched: make(chan struct{}),
+	}
+	go r.dispatch()
+
+	return r, nil
+}
+
+// Claim sets the key only if nobody else has it
+func (r *RedisBackend) Claim(key string, value string, ttl time.Duration) (bool, error) {
+
+	return r.client.SetNX(context.Background(), key, value, ttl).Result()
+}
+
+// Refresh pushes out the key's expiry as long as it still holds the value
+func (r *RedisBackend) Refresh(key string, value string, ttl time.Duration) (bool, error) {
+
+	n, err := refreshScript.Run(context.Background(), r.client, []string{key}, value, ttl.Milliseconds()).Int()
+	return n == 1, err
+}
+
+// Release removes the key as long as it still holds the value
+func (r *RedisBackend) Release(key string, value string) error {
+
+	return releaseScript.Run(context.Background(), r.client, []string{key}, value).Err()
+}
+
+// Set puts the value in the key whether or not it's there already
+func (r *RedisBackend) Set(key string, value string, ttl time.Duration) error {
+
+	return r.client.Set(context.Background(), key, value, ttl).Err()
+}
+
+// Get finds the value in the key if it hasn't expired
+func (r *RedisBackend) Get(key string) (string, bool, error) {
+
+	value, err := r.client.Get(context.Background(), key).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// Delete removes the key
+func (r *RedisBackend) Delete(key string) error {
+
+	return r.client.Del(context.Background(), key).Err()
+}
+
+// Scan finds every key under the prefix along with its value
+// keys that expire partway through are left out
+func (r *RedisBackend) Scan(prefix string) (map[string]string, error) {
+
+	ctx := context.Background()
+	found := make(map[string]string)
+
+	keys := r.client.Scan(ctx, 0, prefix+"*", 100).Iterator()
+	for keys.Next(ctx) {
+
+		value, err := r.client.Get(ctx, keys.Val()).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		found[keys.Val()] = value
+	}
+	return found, keys.Err()
+}
+
+// Publish sends the message to everyone subscribed to the channel
+func (r *RedisBackend) Publish(channel string, message []byte) error {
+
+	return r.client.Publish(context.Background(), channel, message).Err()
+}
+
+// Subscribe starts listening to the channel
+// the instance is already listening to everything under the prefix
+// so anything published once this returns gets through
+func (r *RedisBackend) Subscribe(channel string) (Subscription, error) {
+
+	return r.local.Subscribe(channel)
+}
+
+// Close disconnects from redis and ends every subscription
+func (r *RedisBackend) Close() error {
+
+	r.pubsub.Close()
+	err := r.client.Close()
+	<-r.dispatched
+	return err
+}
+
+//***********************************************************************************************
+//
+// Internal
+//
+//***********************************************************************************************
+
+// dispatch hands each message from redis to whoever is listening
+// to its channel here until the backend is closed
+// the same as in memory a subscription that falls too far behind misses out
+func (r *RedisBackend) dispatch() {
+
+	defer close(r.dispatched)
+	defer r.local.Close()
+
+	for message := range r.pubsub.Channel(redis.WithChannelSize(subscriptionBuffer)) {
+		r.local.Publish(message.Channel, []byte(message.Payload))
+	}
+}
+
+//***********************************************************************************************
+//
+// Structs
+//
+//***********************************************************************************************
+
+// RedisBackend keeps the keys and channels in redis
+// so every instance connected to it can share them
+// the subscriptions here are kept in memory and fed from the one pubsub
+type RedisBackend struct {
+	client     *redis.Client
+	pubsub     *redis.PubSub
+	local      *MemoryBackend
+	dispatched chan struct{}
+}
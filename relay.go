@@ -0,0 +1,718 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// How long a room's claim on its code lasts without being renewed
+// if its instance goes away the code frees up after this long
+const roomLease = 30 * time.Second
+
+// How often rooms renew their claim and relays check the claim is still there
+var leaseCheck = roomLease / 3
+
+// How long someone let into a private room stays on its guest list
+// in the backend, the room keeps its own list for as long as it's open
+const guestLease = 24 * time.Hour
+
+// Hands out the keys relayed clients are known by
+var relayKeys int64
+
+//***********************************************************************************************
+//
+// Enums
+//
+//***********************************************************************************************
+
+// RelayKind is what a relayed message is for
+// join, leave, command and alive go to the room's instance
+// the rest come back from it
+type RelayKind string
+
+const (
+	RelayJoin    RelayKind = "join"
+	RelayLeave   RelayKind = "leave"
+	RelayCommand RelayKind = "command"
+	RelayAlive   RelayKind = "alive"
+	RelayAdmit   RelayKind = "admit"
+	RelaySend    RelayKind = "send"
+	RelayClose   RelayKind = "close"
+	RelayClosed  RelayKind = "closed"
+)
+
+//***********************************************************************************************
+//
+// Internal
+//
+//***********************************************************************************************
+
+// claimCode registers the room in the backend so the other instances
+// send their guests here, it listens for them before the claim goes in
+// so nobody who finds the room can be missed
+// if the backend can't be reached the room still runs for this instance
+func (room *Room) claimCode() (Subscription, bool) {
+
+	sub, err := backend.Subscribe(inboxChannel(room.ID))
+	if err != nil {
+
+		log.Println("Error listening for other instances in room", room.ID, err)
+		return nil, true
+	}
+
+	data, err := json.Marshal(RoomClaim{
+		Instance: instanceID,
+		Public:   room.Public,
+		Password: room.password,
+	})
+	if err != nil {
+		log.Println("Error claiming room", room.ID, err)
+		return sub, true
+	}
+
+	claimed, err := backend.Claim(roomKey(room.ID), string(data), roomLease)
+	if err != nil {
+
+		log.Println("Error claiming room", room.ID, err)
+		return sub, true
+
+	} else if !claimed {
+
+		sub.Close()
+		return nil, false
+	}
+
+	room.claim = string(data)
+	return sub, true
+}
+
+// renew keeps the room's claim and listing from running out
+// it reports false once another instance has taken the code
+// since two instances can't both host the room
+// this must only be called from the room's routine
+func (room *Room) renew() bool {
+
+	if room.claim == "" {
+		return true
+	}
+
+	held, err := backend.Refresh(roomKey(room.ID), room.claim, roomLease)
+	if err != nil {
+		log.Println("Error renewing room", room.ID, err)
+	} else if !held {
+
+		// the claim might only have run out, if so it's still ours to take
+		claimed, err := backend.Claim(roomKey(room.ID), room.claim, roomLease)
+		if err != nil {
+			log.Println("Error renewing room", room.ID, err)
+		} else if !claimed {
+
+			log.Println("Room", room.ID, "lost its claim to another instance")
+			room.claim = ""
+			return false
+		}
+	}
+
+	room.shareListing(room.Listing())
+	return true
+}
+
+// release gives up the room's claim so the code can be used again
+// and stops the room renewing it
+// this must only be called from the room's routine
+func (room *Room) release() {
+
+	if room.claim == "" {
+		return
+	}
+
+	if err := backend.Release(roomKey(room.ID), room.claim); err != nil {
+		log.Println("Error releasing room", room.ID, err)
+	}
+	backend.Delete(listingKey(room.ID))
+	backend.Delete(lobbyKey(room.ID))
+	room.claim = ""
+}
+
+// forgetGuests clears the room's guest list out of the backend
+// once the room is gone for good
+func (room *Room) forgetGuests() {
+
+	if room.claim == "" || room.password == nil {
+		return
+	}
+
+	guests, err := backend.Scan(guestsKey(room.ID))
+	if err != nil {
+		log.Println("Error clearing guest list for room", room.ID, err)
+		return
+	}
+	for key := range guests {
+		backend.Delete(key)
+	}
+}
+
+// releaseRooms gives up the claims on every room hosted here
+// so they're free to be opened again as soon as the server is back
+func releaseRooms() {
+
+	hotel.Range(func(room *Room) bool {
+
+		// relays have nothing to give up
+		if room.owner != "" {
+			return true
+		}
+
+		reply := make(chan struct{})
+		select {
+		case room.releases <- reply:
+			<-reply
+		case <-room.done:
+		}
+		return true
+	})
+}
+
+// shareListing lets the other instances see how full the room is
+func (room *Room) shareListing(listing Listing) {
+
+	if room.claim == "" {
+		return
+	}
+
+	data, err := json.Marshal(listing)
+	if err != nil {
+		log.Println("Error sharing listing for room", room.ID, err)
+		return
+	}
+	if err := backend.Set(listingKey(room.ID), string(data), roomLease); err != nil {
+		log.Println("Error sharing listing for room", room.ID, err)
+	}
+
+	// public rooms show up in the lobby on every instance
+	if room.Public {
+		if err := backend.Set(lobbyKey(room.ID), string(data), roomLease); err != nil {
+			log.Println("Error sharing listing for room", room.ID, err)
+		}
+	}
+}
+
+// shareChange lets the lobby here and on every other instance
+// know one of the public rooms has changed
+func (room *Room) shareChange() {
+
+	directory.changed()
+
+	if room.claim == "" {
+		return
+	}
+	if err := backend.Publish(lobbyChannel(), []byte(room.ID)); err != nil {
+		log.Println("Error sharing lobby change for room", room.ID, err)
+	}
+}
+
+// host takes in the guests other instances relay to the room
+// each one gets a client here that stands in for the real one over there
+// an instance that stops checking in is taken for gone along with its stand ins
+func (room *Room) host(sub Subscription) {
+
+	defer sub.Close()
+
+	// the stand ins by instance and key
+	// and when each instance was last heard from
+	remotes := make(map[string]*Client)
+	heard := make(map[string]time.Time)
+
+	// relays check in every time they check on the room
+	// so missing a few in a row means the instance is gone
+	check := time.NewTicker(room.checkEvery)
+	defer check.Stop()
+
+	for {
+
+		select {
+
+		case <-check.C:
+
+			for id, c := range remotes {
+				if time.Since(heard[c.instance]) > room.checkEvery*3 {
+
+					log.Println("Instance", c.instance, "stopped relaying to room", room.ID)
+					delete(remotes, id)
+					c.checkout()
+				}
+			}
+
+		case data, open := <-sub.Messages():
+
+			if !open {
+				return
+			}
+
+			var message Relayed
+			if err := json.Unmarshal(data, &message); err != nil {
+				log.Println("Error reading relayed message for room", room.ID, err)
+				continue
+			}
+			id := message.Instance + "/" + message.Key
+			heard[message.Instance] = time.Now()
+
+			switch message.Kind {
+
+			case RelayJoin:
+
+				c := &Client{
+					room:      room,
+					ID:        message.Player,
+					Name:      message.Name,
+					Spectator: message.Spectator,
+					send:      NewOutbox(*sendQueue, overflowPolicy),
+					admit:     make(chan error, 1),
+					instance:  message.Instance,
+					key:       message.Key,
+				}
+
+				select {
+				case room.checkin <- c:
+				case <-room.done:
+					return
+				}
+
+				reply := Relayed{Kind: RelayAdmit, Instance: c.instance, Key: c.key}
+				if err := <-c.admit; err != nil {
+					reply.Error = err.Error()
+				} else {
+					remotes[id] = c
+					go room.forward(c)
+				}
+				room.announce(reply)
+
+			case RelayLeave:
+
+				if c, ok := remotes[id]; ok {
+					delete(remotes, id)
+					c.checkout()
+				}
+
+			case RelayCommand:
+
+				// starting the game is the only command without a client
+				c, ok := remotes[id]
+				if !ok && message.Command != StartEntry {
+					continue
+				}
+
+				command, err := decodeCommand(message.Command, message.Body, c)
+				if err != nil {
+					log.Println("Error reading relayed command for room", room.ID, err)
+					continue
+				}
+				room.do(command)
+			}
+
+		case <-room.done:
+
+			// the relays only listen to the instance they think has the room
+			room.announce(Relayed{Kind: RelayClosed, Instance: instanceID})
+			return
+		}
+	}
+}
+
+// forward sends everything the room queues up for a stand in
+// back to the instance the real client is on
+func (room *Room) forward(c *Client) {
+
+	for range c.send.Ready() {
+
+		messages, open := c.send.Drain()
+
+		if len(messages) > 0 {
+
+			send := Relayed{Kind: RelaySend, Instance: c.instance, Key: c.key}
+			for _, message := range messages {
+
+				env := wrap(message)
+				body, err := json.Marshal(env.Body)
+				if err != nil {
+					log.Println("Error relaying message", err)
+					continue
+				}
+				send.Envelopes = append(send.Envelopes, RawEnvelope{Type: env.Type, Body: body})
+			}
+			room.announce(send)
+		}
+
+		if !open {
+			room.announce(Relayed{Kind: RelayClose, Instance: c.instance, Key: c.key})
+			return
+		}
+	}
+}
+
+// openRelay finds a room hosted on another instance
+// and opens a relay to it for the guests on this one
+func openRelay(code string) (*Room, bool) {
+
+	value, ok, err := backend.Get(roomKey(code))
+	if err != nil {
+		log.Println("Error looking up room", code, err)
+		return nil, false
+	}
+	if !ok {
+		return nil, false
+	}
+
+	var claim RoomClaim
+	if err := json.Unmarshal([]byte(value), &claim); err != nil {
+		log.Println("Error reading claim for room", code, err)
+		return nil, false
+	}
+
+	// a claim from here is one the room hasn't released yet on its way out
+	if claim.Instance == instanceID {
+		return nil, false
+	}
+
+	sub, err := backend.Subscribe(outboxChannel(code))
+	if err != nil {
+		log.Println("Error listening to room", code, err)
+		return nil, false
+	}
+
+	// relays don't show up in the lobby since the listing is somebody else's
+	relay := buildRoom(code, false)
+	relay.owner = claim.Instance
+	relay.password = claim.Password
+
+	// another request may have opened a relay first
+	if !hotel.Insert(relay) {
+		sub.Close()
+		return hotel.Get(code)
+	}
+
+	go relay.relay(sub, *relayWait)
+
+	return relay, true
+}
+
+// relay passes the guests on this instance through to the room's instance
+// it runs in place of the room's usual routine and closes the same way
+// when it's been empty for a while, or straight away if the room closes
+// or its instance lets go of the code
+// guests who haven't been let in after the wait are turned away
+func (room *Room) relay(sub Subscription, wait time.Duration) {
+
+	// the clients connected here by their key
+	// and which of them are still waiting to be let in
+	clients := make(map[string]*Client)
+	waiting := make(map[string]bool)
+
+	// where the waits that run out are reported
+	timeouts := make(chan string)
+
+	defer func() {
+
+		log.Printf("Relay to room %v is closing..\n", room.ID)
+
+		hotel.Delete(room.ID)
+		close(room.done)
+		sub.Close()
+
+		for key, c := range clients {
+			if waiting[key] {
+				c.admit <- ErrNoSuchRoom
+			} else {
+				c.send.Close()
+			}
+		}
+	}()
+
+	idle := time.After(room.idle)
+
+	// the room's instance might go away without saying so
+	check := time.NewTicker(room.checkEvery)
+	defer check.Stop()
+
+	for {
+
+		select {
+
+		case c := <-room.checkin:
+
+			c.key = strconv.FormatInt(atomic.AddInt64(&relayKeys, 1), 10)
+			clients[c.key] = c
+			waiting[c.key] = true
+			idle = nil
+
+			room.tell(Relayed{
+				Kind:      RelayJoin,
+				Key:       c.key,
+				Player:    c.ID,
+				Name:      c.Name,
+				Spectator: c.Spectator,
+			})
+
+			key := c.key
+			time.AfterFunc(wait, func() {
+				select {
+				case timeouts <- key:
+				case <-room.done:
+				}
+			})
+
+		case key := <-timeouts:
+
+			if waiting[key] {
+
+				log.Println("Room", room.ID, "never let a guest in, turning them away")
+				c := clients[key]
+				delete(clients, key)
+				delete(waiting, key)
+				c.admit <- ErrNoSuchRoom
+
+				// in case the room gets to them after all
+				room.tell(Relayed{Kind: RelayLeave, Key: key})
+			}
+
+		case <-check.C:
+
+			if !room.ownerHolds() {
+				log.Println("Room", room.ID, "is no longer on instance", room.owner)
+				return
+			}
+
+			// let the room know the guests here are still connected
+			if len(clients) > 0 {
+				room.tell(Relayed{Kind: RelayAlive})
+			}
+
+		case c := <-room.checkout:
+
+			if clients[c.key] == c {
+
+				delete(clients, c.key)
+				delete(waiting, c.key)
+				c.send.Close()
+				room.tell(Relayed{Kind: RelayLeave, Key: c.key})
+			}
+
+		case command := <-room.commands:
+
+			kind, c, body, ok := encodeCommand(command)
+			if !ok {
+				continue
+			}
+
+			message := Relayed{Kind: RelayCommand, Command: kind}
+			if c != nil {
+				message.Key = c.key
+			}
+			if body != nil {
+
+				data, err := json.Marshal(body)
+				if err != nil {
+					log.Println("Error relaying command", err)
+					continue
+				}
+				message.Body = data
+			}
+			room.tell(message)
+
+		case data, open := <-sub.Messages():
+
+			if !open {
+				return
+			}
+
+			var message Relayed
+			if err := json.Unmarshal(data, &message); err != nil {
+				log.Println("Error reading relayed message for room", room.ID, err)
+				continue
+			}
+
+			// an instance that lost the room might still say it closed
+			if message.Kind == RelayClosed {
+				if message.Instance == room.owner {
+					return
+				}
+				continue
+			}
+
+			// everything else is for one client, maybe on another instance
+			c, ok := clients[message.Key]
+			if message.Instance != instanceID || !ok {
+				continue
+			}
+
+			switch message.Kind {
+
+			case RelayAdmit:
+
+				delete(waiting, c.key)
+				if message.Error != "" {
+					delete(clients, c.key)
+					c.admit <- errors.New(message.Error)
+				} else {
+					c.admit <- nil
+				}
+
+			case RelaySend:
+
+				for _, env := range message.Envelopes {
+
+					if !c.send.Push(Envelope{Type: env.Type, Body: env.Body}) {
+						log.Println("Client fell too far behind, dropping them from room", room.ID)
+						c.send.Close()
+						break
+					}
+				}
+
+			case RelayClose:
+
+				// the writer closes the socket which checks the client out
+				c.send.Close()
+			}
+
+		case <-idle:
+
+			if len(clients) == 0 {
+				return
+			}
+		}
+
+		if len(clients) == 0 && idle == nil {
+			idle = time.After(room.idle)
+		}
+	}
+}
+
+// ownerHolds checks the room's instance still has its claim on the code
+// if the backend can't be reached it gets the benefit of the doubt
+func (room *Room) ownerHolds() bool {
+
+	value, ok, err := backend.Get(roomKey(room.ID))
+	if err != nil {
+		log.Println("Error looking up room", room.ID, err)
+		return true
+	}
+	if !ok {
+		return false
+	}
+
+	var claim RoomClaim
+	if err := json.Unmarshal([]byte(value), &claim); err != nil {
+		log.Println("Error reading claim for room", room.ID, err)
+		return false
+	}
+	return claim.Instance == room.owner
+}
+
+// fetchListing picks up the latest listing the room's instance shared
+func (room *Room) fetchListing() {
+
+	value, ok, err := backend.Get(listingKey(room.ID))
+	if err != nil {
+		log.Println("Error looking up listing for room", room.ID, err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	var listing Listing
+	if err := json.Unmarshal([]byte(value), &listing); err != nil {
+		log.Println("Error reading listing for room", room.ID, err)
+		return
+	}
+	room.listing.Store(listing)
+}
+
+// tell sends a message from this instance to the room's instance
+func (room *Room) tell(message Relayed) {
+
+	message.Instance = instanceID
+	room.post(inboxChannel(room.ID), message)
+}
+
+// announce sends a message from the room out to every relay
+func (room *Room) announce(message Relayed) {
+
+	room.post(outboxChannel(room.ID), message)
+}
+
+// post puts the message on the channel
+func (room *Room) post(channel string, message Relayed) {
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Println("Error relaying message for room", room.ID, err)
+		return
+	}
+	if err := backend.Publish(channel, data); err != nil {
+		log.Println("Error relaying message for room", room.ID, err)
+	}
+}
+
+// the keys and channels rooms are shared under
+func roomKey(code string) string       { return backendPrefix + "room:" + code }
+func listingKey(code string) string    { return backendPrefix + "listing:" + code }
+func lobbyKey(code string) string      { return backendPrefix + "lobby:" + code }
+func lobbyChannel() string             { return backendPrefix + "lobby" }
+func inboxChannel(code string) string  { return backendPrefix + "room:" + code + ":in" }
+func outboxChannel(code string) string { return backendPrefix + "room:" + code + ":out" }
+
+// guestKey is where a guest on a room's guest list is kept
+// the uid is hashed so nobody reading the backend can take their seat
+func guestKey(code string, uid string) string {
+
+	return guestsKey(code) + PlayerID(uid)
+}
+
+// guestsKey is what every key on the room's guest list starts with
+func guestsKey(code string) string {
+
+	return fmt.Sprintf("%vguest:%v:", backendPrefix, code)
+}
+
+//***********************************************************************************************
+//
+// Structs
+//
+//***********************************************************************************************
+
+// RoomClaim is what the backend knows about a room
+// the password is the same hash the room keeps
+type RoomClaim struct {
+	Instance string `json:"instance"`
+	Public   bool   `json:"public"`
+	Password []byte `json:"password,omitempty"`
+}
+
+// Relayed is a message between a room and a relay on another instance
+// clients are known by the relay's instance and the key it gave them
+// and a room closing gives its own instance, players only ever go by
+// their hashed id so nobody listening in can take their seat
+type Relayed struct {
+	Kind      RelayKind       `json:"kind"`
+	Instance  string          `json:"instance,omitempty"`
+	Key       string          `json:"key,omitempty"`
+	Player    string          `json:"player,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Spectator bool            `json:"spectator,omitempty"`
+	Command   EntryKind       `json:"command,omitempty"`
+	Body      json.RawMessage `json:"body,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Envelopes []RawEnvelope   `json:"envelopes,omitempty"`
+}
+
+// RawEnvelope is an envelope that has already been turned into json
+type RawEnvelope struct {
+	Type string          `json:"type"`
+	Body json.RawMessage `json:"body"`
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// nextRelayed waits for the next relayed message of the kind
+// anything else on the channel is skipped over
+func nextRelayed(t *testing.T, sub Subscription, kind RelayKind) Relayed {
+
+	timeout := time.After(time.Second * 5)
+	for {
+
+		select {
+
+		case data := <-sub.Messages():
+
+			var message Relayed
+			if err := json.Unmarshal(data, &message); err != nil {
+				t.Fatal("Error reading relayed message", err)
+			}
+			if message.Kind == kind {
+				return message
+			}
+
+		case <-timeout:
+			t.Fatal("Expected", "a relayed", kind, "got", "nothing")
+		}
+	}
+}
+
+// relay publishes a message as if it came from another instance
+func relay(t *testing.T, channel string, message Relayed) {
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		t.Fatal("Error writing relayed message", err)
+	}
+	if err := backend.Publish(channel, data); err != nil {
+		t.Fatal("Error publishing relayed message", err)
+	}
+}
+
+func TestHostsGuestsFromAnotherInstance(t *testing.T) {
+
+	room := CreateRoom("", false)
+
+	// pretend to be another instance with a guest who wants in
+	out, err := backend.Subscribe(outboxChannel(room.ID))
+	if err != nil {
+		t.Fatal("Error subscribing", err)
+	}
+	defer out.Close()
+
+	relay(t, inboxChannel(room.ID), Relayed{
+		Kind:     RelayJoin,
+		Instance: "other-instance",
+		Key:      "1",
+		Player:   PlayerID("remote-" + room.ID),
+		Name:     "Ann",
+	})
+
+	admit := nextRelayed(t, out, RelayAdmit)
+	if admit.Instance != "other-instance" || admit.Key != "1" || admit.Error != "" {
+		t.Error("Expected", "Ann to be let in", "got", admit)
+	}
+
+	// the room sends them the game the same as anyone
+	for state := false; !state; {
+
+		send := nextRelayed(t, out, RelaySend)
+		if send.Instance != "other-instance" || send.Key != "1" {
+			t.Fatal("Expected", "messages for Ann", "got", send)
+		}
+		for _, env := range send.Envelopes {
+			state = state || env.Type == "state"
+		}
+	}
+
+	// and takes their commands
+	nouns, _ := json.Marshal([]Noun{{Person, "Ada"}, {Place, "Paris"}, {Thing, "Lamp"}})
+	relay(t, inboxChannel(room.ID), Relayed{
+		Kind:     RelayCommand,
+		Instance: "other-instance",
+		Key:      "1",
+		Command:  SubmitEntry,
+		Body:     nouns,
+	})
+	relay(t, inboxChannel(room.ID), Relayed{Kind: RelayLeave, Instance: "other-instance", Key: "1"})
+
+	// once they leave the room lets the relay know to close them out
+	closed := nextRelayed(t, out, RelayClose)
+	if closed.Key != "1" {
+		t.Error("Expected", "Ann's connection to close", "got", closed)
+	}
+
+	snapshot, ok := room.Snapshot()
+	if !ok {
+		t.Fatal("Expected", "a snapshot", "got", "a closed room")
+	}
+
+	kinds := []EntryKind{}
+	for _, entry := range snapshot.Game.Journal {
+		kinds = append(kinds, entry.Kind)
+	}
+	if len(kinds) != 3 || kinds[0] != JoinEntry || kinds[1] != SubmitEntry || kinds[2] != LeaveEntry {
+		t.Error("Expected", []EntryKind{JoinEntry, SubmitEntry, LeaveEntry}, "got", kinds)
+	}
+	if len(snapshot.Game.Nouns.All) != 3 {
+		t.Error("Expected", 3, "got", len(snapshot.Game.Nouns.All))
+	}
+}
+
+func TestRelaysToRoomOnAnotherInstance(t *testing.T) {
+
+	// another instance has the room
+	code := newCode()
+	claim, _ := json.Marshal(RoomClaim{Instance: "other-instance"})
+	backend.Claim(roomKey(code), string(claim), roomLease)
+	listing, _ := json.Marshal(Listing{ID: code, Players: 1, MaxPlayers: 1})
+	backend.Set(listingKey(code), string(listing), roomLease)
+
+	in, err := backend.Subscribe(inboxChannel(code))
+	if err != nil {
+		t.Fatal("Error subscribing", err)
+	}
+	defer in.Close()
+
+	room, ok := GetRoom(code)
+	if !ok || room.owner != "other-instance" {
+		t.Fatal("Expected", "a relay to the other instance", "got", room, ok)
+	}
+	if room.HasSpace(false) {
+		t.Error("Expected", "the other instance's listing", "got", room.Listing())
+	}
+	if _, ok := room.Snapshot(); ok {
+		t.Error("Expected", "nothing to save for a relay", "got", "a snapshot")
+	}
+
+	// a guest on this instance joins through the relay
+	server := httptest.NewServer(RequireSession(socketHandler, refuseSocket))
+	defer server.Close()
+
+	conn, err := dialRoom(server, room, "relayed-"+code)
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer conn.Close()
+
+	join := nextRelayed(t, in, RelayJoin)
+	if join.Instance != instanceID || join.Player != PlayerID("relayed-"+code) || join.Name != "relayed-"+code {
+		t.Error("Expected", "the guest to be relayed", "got", join)
+	}
+
+	relay(t, outboxChannel(code), Relayed{Kind: RelayAdmit, Instance: instanceID, Key: join.Key})
+	relay(t, outboxChannel(code), Relayed{
+		Kind:      RelaySend,
+		Instance:  instanceID,
+		Key:       join.Key,
+		Envelopes: []RawEnvelope{{Type: "state", Body: json.RawMessage(`{"round":3}`)}},
+	})
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	var state struct {
+		Type string `json:"type"`
+		Body struct {
+			Round int `json:"round"`
+		} `json:"body"`
+	}
+	if err := conn.ReadJSON(&state); err != nil || state.Type != "state" || state.Body.Round != 3 {
+		t.Error("Expected", "round 3", "got", state, err)
+	}
+
+	// what they send goes back to the other instance
+	conn.WriteJSON(Envelope{Type: "message", Body: map[string]string{"message": "hello"}})
+
+	command := nextRelayed(t, in, RelayCommand)
+	if command.Key != join.Key || command.Command != MessageEntry || string(command.Body) != `"hello"` {
+		t.Error("Expected", "hello from the guest", "got", command)
+	}
+
+	// the room closing over there closes the guest's connection here
+	relay(t, outboxChannel(code), Relayed{Kind: RelayClosed, Instance: "other-instance"})
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("Expected", "the connection to close", "got", nil)
+	}
+}
+
+func TestRelayGivesUpWaitingToBeLetIn(t *testing.T) {
+
+	wait := *relayWait
+	*relayWait = time.Millisecond * 50
+	defer func() { *relayWait = wait }()
+
+	// the instance with the room is gone and never answers
+	code := newCode()
+	claim, _ := json.Marshal(RoomClaim{Instance: "gone-instance"})
+	backend.Claim(roomKey(code), string(claim), roomLease)
+
+	in, err := backend.Subscribe(inboxChannel(code))
+	if err != nil {
+		t.Fatal("Error subscribing", err)
+	}
+	defer in.Close()
+
+	room, ok := GetRoom(code)
+	if !ok {
+		t.Fatal("Expected", "a relay", "got", "nothing")
+	}
+
+	server := httptest.NewServer(RequireSession(socketHandler, refuseSocket))
+	defer server.Close()
+
+	conn, err := dialRoom(server, room, "waiting-"+code)
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Error("Expected", "the guest to be turned away", "got", err)
+	}
+
+	// and the room is told to forget them in case it was only slow
+	join := nextRelayed(t, in, RelayJoin)
+	if leave := nextRelayed(t, in, RelayLeave); leave.Key != join.Key {
+		t.Error("Expected", join.Key, "got", leave.Key)
+	}
+}
+
+func TestRelayClosesWhenRoomMovesOn(t *testing.T) {
+
+	check := leaseCheck
+	leaseCheck = time.Millisecond * 20
+	defer func() { leaseCheck = check }()
+
+	code := newCode()
+	claim, _ := json.Marshal(RoomClaim{Instance: "other-instance"})
+	backend.Claim(roomKey(code), string(claim), roomLease)
+
+	room, ok := GetRoom(code)
+	if !ok {
+		t.Fatal("Expected", "a relay", "got", "nothing")
+	}
+
+	// another room closing under the same code doesn't count
+	relay(t, outboxChannel(code), Relayed{Kind: RelayClosed, Instance: "someone-else"})
+
+	select {
+	case <-room.done:
+		t.Fatal("Expected", "the relay to stay open", "got", "it closed")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	// the other instance went away without saying so
+	backend.Delete(roomKey(code))
+
+	select {
+	case <-room.done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected", "the relay to close", "got", "it still open")
+	}
+	if _, ok := hotel.Get(code); ok {
+		t.Error("Expected", "the relay to leave the hotel", "got", "it still there")
+	}
+}
+
+func TestRoomClosesWhenClaimIsTaken(t *testing.T) {
+
+	room := buildRoom(newCode(), true)
+	room.checkEvery = time.Millisecond * 20
+	if !room.open() {
+		t.Fatal("Expected", "the room to open", "got", "its code taken")
+	}
+
+	// another instance took the code over
+	claim, _ := json.Marshal(RoomClaim{Instance: "other-instance"})
+	backend.Set(roomKey(room.ID), string(claim), roomLease)
+
+	select {
+	case <-room.done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected", "the room to close", "got", "it still open")
+	}
+
+	// and it's left with the code
+	if value, ok, _ := backend.Get(roomKey(room.ID)); !ok || value != string(claim) {
+		t.Error("Expected", string(claim), "got", value, ok)
+	}
+}
+
+func TestClosedRoomForgetsGuests(t *testing.T) {
+
+	room := buildRoom(newCode(), false)
+	room.password = hashPassword("secret")
+	room.idle = time.Millisecond * 50
+
+	// checking the password takes a while so the guest
+	// gets in before the room starts counting down
+	uid := "guest-" + room.ID
+	if err := room.LetIn(uid, "secret"); err != nil {
+		t.Fatal("Expected", nil, "got", err)
+	}
+	if _, ok, _ := backend.Get(guestKey(room.ID, uid)); !ok {
+		t.Fatal("Expected", "the guest in the backend", "got", "nothing")
+	}
+
+	if !room.open() {
+		t.Fatal("Expected", "the room to open", "got", "its code taken")
+	}
+
+	select {
+	case <-room.done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected", "the room to close", "got", "it still open")
+	}
+
+	if guests, _ := backend.Scan(guestsKey(room.ID)); len(guests) != 0 {
+		t.Error("Expected", "no guests left", "got", guests)
+	}
+}
+
+func TestReleasedRoomsStayReleased(t *testing.T) {
+
+	room := buildRoom(newCode(), false)
+	room.checkEvery = time.Millisecond * 5
+	if !room.open() {
+		t.Fatal("Expected", "the room to open", "got", "its code taken")
+	}
+
+	// shutting down hands the release to the room's routine
+	// which carries on renewing until then
+	time.Sleep(time.Millisecond * 20)
+	releaseRooms()
+
+	// and the room doesn't claim the code back afterwards
+	time.Sleep(time.Millisecond * 20)
+	if value, ok, _ := backend.Get(roomKey(room.ID)); ok {
+		t.Error("Expected", "the code to be free", "got", value)
+	}
+}
+
+func TestStandInsLeaveWithTheirInstance(t *testing.T) {
+
+	room := buildRoom(newCode(), false)
+	room.checkEvery = time.Millisecond * 20
+	if !room.open() {
+		t.Fatal("Expected", "the room to open", "got", "its code taken")
+	}
+
+	out, err := backend.Subscribe(outboxChannel(room.ID))
+	if err != nil {
+		t.Fatal("Error subscribing", err)
+	}
+	defer out.Close()
+
+	// one instance keeps checking in and the other goes quiet
+	for _, instance := range []string{"live-instance", "lost-instance"} {
+
+		relay(t, inboxChannel(room.ID), Relayed{
+			Kind:     RelayJoin,
+			Instance: instance,
+			Key:      "1",
+			Player:   PlayerID(instance + room.ID),
+			Name:     instance,
+		})
+		if admit := nextRelayed(t, out, RelayAdmit); admit.Error != "" {
+			t.Fatal("Expected", instance, "to be let in got", admit.Error)
+		}
+	}
+
+	alive, _ := json.Marshal(Relayed{Kind: RelayAlive, Instance: "live-instance"})
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-time.After(time.Millisecond * 10):
+				backend.Publish(inboxChannel(room.ID), alive)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	closed := nextRelayed(t, out, RelayClose)
+	if closed.Instance != "lost-instance" {
+		t.Error("Expected", "lost-instance", "got", closed.Instance)
+	}
+
+	snapshot, ok := room.Snapshot()
+	if !ok {
+		t.Fatal("Expected", "a snapshot", "got", "a closed room")
+	}
+
+	left := 0
+	for _, entry := range snapshot.Game.Journal {
+		if entry.Kind == LeaveEntry {
+			left++
+		}
+	}
+	if left != 1 {
+		t.Error("Expected", "only the lost player to leave", "got", left)
+	}
+}
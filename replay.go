@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Keeps the event logs of finished games so they can be watched again
+var replays = NewReplays()
+
+// How much faster or slower than real time a replay can go
+const (
+	minReplaySpeed = 0.25
+	maxReplaySpeed = 16
+)
+
+//***********************************************************************************************
+//
+// External
+//
+//***********************************************************************************************
+
+// NewReplays builds an empty set of replays that only lives in memory
+// until it's opened on a folder
+func NewReplays() *Replays {
+
+	return &Replays{
+		logs: make(map[string][]Event),
+	}
+}
+
+// Open keeps every replay as its own file in the folder from then on
+func (r *Replays) Open(dir string) error {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.dir = dir
+	return nil
+}
+
+// Add keeps the event log for the match
+func (r *Replays) Add(id string, events []Event) error {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.logs[id] = events
+
+	if r.dir == "" {
+		return nil
+	}
+
+	file, err := os.Create(r.path(id))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// one event per line
+	encoder := json.NewEncoder(file)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get finds the event log for the match
+// logs from before the last restart get read back in from their file
+func (r *Replays) Get(id string) ([]Event, bool) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if events, ok := r.logs[id]; ok {
+		return events, true
+	}
+
+	if r.dir == "" || filepath.Base(id) != id {
+		return nil, false
+	}
+
+	file, err := os.Open(r.path(id))
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+
+	events := []Event{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			log.Println("Error reading replay", id, err)
+			return nil, false
+		}
+		events = append(events, event)
+	}
+
+	r.logs[id] = events
+	return events, true
+}
+
+// Replay streams the events down the websocket the same way the room sent them
+// the viewer can send a speed envelope at any point to speed up or slow down
+func Replay(conn *websocket.Conn, events []Event, speed float64) {
+
+	defer conn.Close()
+
+	speeds := make(chan float64)
+	gone := make(chan struct{})
+	finished := make(chan struct{})
+	defer close(finished)
+
+	// listen for the viewer changing the speed or going away
+	go func() {
+
+		defer close(gone)
+
+		conn.SetReadLimit(*maxMessageSize)
+		for {
+
+			var body json.RawMessage
+			env := Envelope{Body: &body}
+			if err := conn.ReadJSON(&env); err != nil {
+				return
+			}
+
+			if env.Type != "speed" {
+				continue
+			}
+
+			change := struct {
+				Speed float64 `json:"speed"`
+			}{}
+			if err := json.Unmarshal(body, &change); err != nil {
+				log.Println("Error unmarshalling json for speed:", err)
+				continue
+			}
+
+			select {
+			case speeds <- change.Speed:
+			case <-finished:
+				return
+			}
+		}
+	}()
+
+	speed = clampSpeed(speed)
+	wait := *writeWait
+
+	// the playhead is how far into the game the replay has got
+	var playhead time.Duration
+
+	for _, event := range events {
+
+		for playhead < event.At {
+
+			started := time.Now()
+			timer := time.NewTimer(time.Duration(float64(event.At-playhead) / speed))
+
+			select {
+
+			case <-timer.C:
+				playhead = event.At
+
+			case change := <-speeds:
+				timer.Stop()
+				playhead += time.Duration(float64(time.Since(started)) * speed)
+				speed = clampSpeed(change)
+
+			case <-gone:
+				timer.Stop()
+				return
+			}
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(wait))
+		err := conn.WriteJSON(Envelope{Type: event.Type, Body: event.Body})
+		if err != nil {
+			log.Println("Received error writing replay:", err)
+			return
+		}
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(wait))
+	conn.WriteMessage(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "That's the end of the game."))
+}
+
+//***********************************************************************************************
+//
+// Internal
+//
+//***********************************************************************************************
+
+// path is where the replay for the match is kept
+func (r *Replays) path(id string) string {
+
+	return filepath.Join(r.dir, id+".jsonl")
+}
+
+// clampSpeed keeps the speed to something watchable
+func clampSpeed(speed float64) float64 {
+
+	if speed < minReplaySpeed {
+		return minReplaySpeed
+	}
+	if speed > maxReplaySpeed {
+		return maxReplaySpeed
+	}
+	return speed
+}
+
+// logEvent adds whatever was just sent out to the game's event log
+// the message is wrapped up right away so the log never
+// changes along with the game
+func (g *Game) logEvent(message interface{}) {
+
+	env := wrap(message)
+
+	body, err := json.Marshal(env.Body)
+	if err != nil {
+		log.Println("Error recording event", err)
+		return
+	}
+
+	g.Events = append(g.Events, Event{
+		At:   g.time().Sub(g.StartedAt),
+		Type: env.Type,
+		Body: body,
+	})
+}
+
+//***********************************************************************************************
+//
+// Structs
+//
+//***********************************************************************************************
+
+// Replays is every finished game's event log along with where they're kept
+type Replays struct {
+	mu   sync.Mutex
+	logs map[string][]Event
+	dir  string
+}
+
+// Event is something the room sent out during a game
+// along with how far into the game it happened
+type Event struct {
+	At   time.Duration   `json:"at"`
+	Type string          `json:"type"`
+	Body json.RawMessage `json:"body"`
+}
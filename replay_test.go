@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialReplay connects to the replay of the match at the speed
+func dialReplay(server *httptest.Server, id string, speed string) (*websocket.Conn, error) {
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/replay/ws/" + id + "?speed=" + speed
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	return conn, err
+}
+
+func TestGamesAreLoggedForReplay(t *testing.T) {
+
+	room := playThrough(t, 1, 0)
+	match := history.Find(room.ID, "")[0]
+
+	events, ok := replays.Get(match.ID)
+	if !ok || len(events) == 0 {
+		t.Fatal("Expected", "an event log", "got", events)
+	}
+
+	if events[0].Type != "state" || events[1].Type != "start" || events[len(events)-1].Type != "over" {
+		t.Error("Expected", "state, start, ..., over", "got", events[0].Type, events[1].Type, events[len(events)-1].Type)
+	}
+
+	guesses := 0
+	for i, event := range events {
+
+		if i > 0 && event.At < events[i-1].At {
+			t.Error("Expected", "events in order", "got", events[i-1].At, "then", event.At)
+		}
+		if event.Type == "guess" {
+			guesses++
+		}
+
+		// anyone holding a user id could take that player's seat
+		if strings.Contains(string(event.Body), room.ID+"-ann") {
+			t.Error("Expected", "no user ids in the log", "got", string(event.Body))
+		}
+	}
+	if guesses != 6 {
+		t.Error("Expected", 6, "got", guesses)
+	}
+
+	// and it plays back the same way
+	server := httptest.NewServer(http.HandlerFunc(replaySocketHandler))
+	defer server.Close()
+
+	conn, err := dialReplay(server, match.ID, "16")
+	if err != nil {
+		t.Fatal("Error dialing replay", err)
+	}
+	defer conn.Close()
+
+	for _, event := range events {
+
+		env := received{}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if err := conn.ReadJSON(&env); err != nil || env.Type != event.Type {
+			t.Fatal("Expected", event.Type, "got", env.Type, err)
+		}
+	}
+
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Error("Expected", "the replay to close when it's done", "got", err)
+	}
+}
+
+func TestReplaySpeedCanChange(t *testing.T) {
+
+	id := newCode()
+	replays.Add(id, []Event{
+		{At: 0, Type: "state", Body: json.RawMessage(`{}`)},
+		{At: 4 * time.Second, Type: "start", Body: json.RawMessage(`null`)},
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(replaySocketHandler))
+	defer server.Close()
+
+	conn, err := dialReplay(server, id, "1")
+	if err != nil {
+		t.Fatal("Error dialing replay", err)
+	}
+	defer conn.Close()
+
+	envs := listen(conn)
+	await(t, envs, "state", nil)
+
+	// four seconds at full speed is a quarter of a second
+	conn.WriteJSON(Envelope{Type: "speed", Body: map[string]float64{"speed": maxReplaySpeed}})
+	await(t, envs, "start", nil)
+}
+
+func TestReplaysSurviveRestart(t *testing.T) {
+
+	dir := t.TempDir()
+
+	before := NewReplays()
+	if err := before.Open(dir); err != nil {
+		t.Fatal("Error opening replays", err)
+	}
+	before.Add("saved", []Event{{At: time.Second, Type: "guess", Body: json.RawMessage(`{"text":"wand"}`)}})
+
+	after := NewReplays()
+	after.Open(dir)
+
+	events, ok := after.Get("saved")
+	if !ok || len(events) != 1 || events[0].At != time.Second || string(events[0].Body) != `{"text":"wand"}` {
+		t.Error("Expected", "the saved replay", "got", events)
+	}
+
+	if _, ok := after.Get("../saved"); ok {
+		t.Error("Expected", "paths to be turned away", "got", "a replay")
+	}
+}
@@ -1,17 +1,40 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
+	"math/big"
 	"net/url"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Join codes are made up of these letters, the vowels
+// are left out so a code never spells anything rude
+const codeLetters = "BCDFGHJKLMNPQRSTVWXZ"
+const codeLength = 6
+
+// Reasons a guest can't be let into a room
+var (
+	ErrWrongPassword = errors.New("That isn't the password for this room.")
+	ErrNoSuchRoom    = errors.New("We couldn't find a room with that code.")
+	ErrRoomTaken     = errors.New("There's already a room with that name.")
+	ErrBadRoomName   = errors.New("Room names need to be 3 to 12 letters or numbers.")
 )
 
-// Generates unique ints for room numbers
-var lastRoomID int64
+// Counts the rooms that have been shut down
+var closedRooms int64
 
 // Keeps track of all the rooms
-var hotel = make(map[int64]*Room)
+var hotel = NewHotel()
 
 //***********************************************************************************************
 //
@@ -19,71 +42,166 @@ var hotel = make(map[int64]*Room)
 //
 //***********************************************************************************************
 
-// CreateRoom builds and tracks a new room
-func CreateRoom() *Room {
+// CreateRoom builds and tracks a new room under a random join code
+// if a password is given only guests who know it can get in
+// public rooms without a password get listed in the lobby
+func CreateRoom(password string, public bool) *Room {
 
-	// increment the room identifier
-	atomic.AddInt64(&lastRoomID, 1)
-	roomID := atomic.LoadInt64(&lastRoomID)
+	// the password only gets hashed once however many codes it takes
+	hash := hashPassword(password)
 
-	newRoom := &Room{
-		ID: roomID,
-		// CurrGame: game,
-		checkin:  make(chan *Client),
-		checkout: make(chan *Client),
-		publish:  make(chan interface{}),
-		clients:  make(map[*Client]bool),
+	// keep trying until we land on a code nobody else is using
+	for {
+		if newRoom, ok := openRoom(newCode(), hash, public); ok {
+			return newRoom
+		}
 	}
+}
 
-	// add room to the list of active rooms
-	hotel[newRoom.ID] = newRoom
+// CreateNamedRoom builds and tracks a new room
+// under a join code the guest picked themselves
+func CreateNamedRoom(code string, password string, public bool) (*Room, error) {
 
-	game := &Game{
-		Room:      newRoom,
-		Broadcast: newRoom.publish,
+	code = NormalizeCode(code)
+	if !validCode(code) {
+		return nil, ErrBadRoomName
 	}
 
-	newRoom.CurrGame = game
-
-	// start the room in a routine
-	go newRoom.run()
-
-	return newRoom
+	newRoom, ok := openRoom(code, hashPassword(password), public)
+	if !ok {
+		return nil, ErrRoomTaken
+	}
+	return newRoom, nil
 }
 
 // GenerateRoomPath takes a request form and returns a path
 // so that the user can be routed to a room
-// if user does not provide a room # then a new one is created
-func GenerateRoomPath(form url.Values) string {
+// if user does not provide a room code then a new one is created
+// and if they asked to create the room they named it gets that code
+// the guest is added to the rooms guest list once they're let in
+func GenerateRoomPath(form url.Values, uid string) (string, error) {
 
 	var route string
 	var roomID string
 
 	xr := form["room"]
 	if len(xr) > 0 {
-		roomID = xr[0]
+		roomID = NormalizeCode(xr[0])
 	}
+	password := form.Get("password")
+	public := form.Get("public") != ""
 
-	if len(roomID) > 0 {
+	if len(roomID) > 0 && form.Get("create") != "" {
 
-		route = fmt.Sprintf("/room/%v", roomID)
+		newRoom, err := CreateNamedRoom(roomID, password, public)
+		if err != nil {
+			return "", err
+		}
+		newRoom.LetIn(uid, password)
+		route = fmt.Sprintf("/room/%v", newRoom.ID)
+
+	} else if len(roomID) > 0 {
+
+		room, ok := GetRoom(roomID)
+		if !ok {
+			return "", ErrNoSuchRoom
+		}
+		if err := room.LetIn(uid, password); err != nil {
+			return "", err
+		}
+		route = fmt.Sprintf("/room/%v", room.ID)
 
 	} else {
 
-		newRoom := CreateRoom()
+		newRoom := CreateRoom(password, public)
+		newRoom.LetIn(uid, password)
 		route = fmt.Sprintf("/room/%v", newRoom.ID)
 	}
 
-	return route
+	return route, nil
 }
 
-// GetRoom checks for a specifc room by its id
-func GetRoom(id int64) (*Room, bool) {
+// GetRoom checks for a specifc room by its join code
+// rooms hosted on another instance are reached through a relay
+func GetRoom(code string) (*Room, bool) {
 
-	room, ok := hotel[id]
+	code = NormalizeCode(code)
+
+	room, ok := hotel.Get(code)
+	if !ok {
+		room, ok = openRelay(code)
+	}
+
+	if ok && room.owner != "" {
+		room.fetchListing()
+	}
 	return room, ok
 }
 
+// NormalizeCode tidies up a join code the way a person might have typed it
+func NormalizeCode(code string) string {
+
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// LetIn checks the password and adds the guest to the guest list
+// rooms without a password let everyone in
+func (room *Room) LetIn(uid string, password string) error {
+
+	if room.password != nil {
+
+		if bcrypt.CompareHashAndPassword(room.password, passwordDigest(password)) != nil {
+			return ErrWrongPassword
+		}
+	}
+
+	room.mu.Lock()
+	room.guests[uid] = true
+	room.mu.Unlock()
+
+	// they might come back through another instance
+	if room.password != nil {
+		if err := backend.Set(guestKey(room.ID, uid), "true", guestLease); err != nil {
+			log.Println("Error sharing guest list for room", room.ID, err)
+		}
+	}
+	return nil
+}
+
+// Invited checks if the guest is allowed in the room
+// they may have been let in on another instance
+func (room *Room) Invited(uid string) bool {
+
+	if room.password == nil {
+		return true
+	}
+
+	room.mu.Lock()
+	invited := room.guests[uid]
+	room.mu.Unlock()
+
+	if invited {
+		return true
+	}
+
+	_, invited, err := backend.Get(guestKey(room.ID, uid))
+	if err != nil {
+		log.Println("Error checking guest list for room", room.ID, err)
+	}
+	if invited {
+		room.mu.Lock()
+		room.guests[uid] = true
+		room.mu.Unlock()
+	}
+	return invited
+}
+
+// IsPrivate checks if the room needs a password
+func (room *Room) IsPrivate() bool {
+
+	return room.password != nil
+}
+
 //***********************************************************************************************
 //
 // Internal
@@ -91,53 +209,336 @@ func GetRoom(id int64) (*Room, bool) {
 //***********************************************************************************************
 
 // Run starts a room and sets up the front desk to check in and check out clients
+// the room closes itself once it has been empty for longer than the idle period
 func (room *Room) run() {
 
 	defer func() {
 
 		log.Printf("All guests have left room %v, sending in the cleanup crew..\n", room.ID)
 
-		close(room.checkin)
-		close(room.checkout)
-		delete(hotel, room.ID)
+		hotel.Delete(room.ID)
+		room.forgetGuests()
+		room.release()
+		close(room.done)
+
+		// anyone still hanging around gets shown the door
+		for client := range room.clients {
+			client.send.Close()
+		}
+		room.CurrGame.end()
+
+		atomic.AddInt64(&closedRooms, 1)
+
+		if room.Public {
+			room.shareChange()
+		}
 	}()
+
+	// rooms start out empty so the clock is already ticking
+	idle := time.After(room.idle)
+
+	// the claim on the code has to be renewed while the room is open
+	lease := time.NewTicker(room.checkEvery)
+	defer lease.Stop()
+
 	for {
 
 		select {
 
 		case client := <-room.checkin:
 
+			if err := room.CurrGame.Admit(client); err != nil {
+
+				log.Println("Turning client away from room", room.ID, err)
+				client.admit <- err
+				continue
+			}
+
 			log.Println("Client checked in to room..")
 
 			room.clients[client] = true
+			client.admit <- nil
 			room.CurrGame.Join(client)
+			idle = nil
 
 			log.Printf("Currently %v connected clients..\n", len(room.clients))
 
 		case client := <-room.checkout:
 
-			if _, ok := room.clients[client]; ok {
-
-				delete(room.clients, client)
-				close(client.send)
-			}
+			room.kick(client)
+			room.CurrGame.Leave(client)
 			log.Println("Client checked out of room..")
 			log.Printf("Currently %v connected clients..\n", len(room.clients))
 
+		case command := <-room.commands:
+
+			room.CurrGame.Do(command)
+
+		case reply := <-room.snapshots:
+
+			reply <- room.snapshot()
+
+		case reply := <-room.releases:
+
+			room.release()
+			close(reply)
+
 		case message := <-room.publish:
-			fmt.Println("room sending to clients", message)
-			for client := range room.clients {
 
-				select {
+			room.deliver(message)
 
-				case client.send <- message:
+		case <-lease.C:
 
-				default:
-					close(client.send)
-					delete(room.clients, client)
-				}
+			// another instance has the code so this one can't keep the room
+			if !room.renew() {
+				return
 			}
+
+		case <-idle:
+
+			if room.empty() {
+				return
+			}
+		}
+
+		if room.empty() && idle == nil {
+			idle = time.After(room.idle)
+		}
+
+		room.tally()
+	}
+}
+
+// openRoom builds a room under the code and starts it up
+// if the code is already taken nothing is started
+// the password comes already hashed
+func openRoom(code string, password []byte, public bool) (*Room, bool) {
+
+	newRoom := buildRoom(code, public && password == nil)
+	newRoom.password = password
+
+	if !newRoom.open() {
+		return nil, false
+	}
+	return newRoom, true
+}
+
+// hashPassword salts and hashes a room password with bcrypt
+// rooms without a password get nothing
+func hashPassword(password string) []byte {
+
+	if password == "" {
+		return nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword(passwordDigest(password), bcrypt.DefaultCost)
+	if err != nil {
+		// the digest always fits so this only happens if the system has no randomness left
+		log.Fatalln("Error hashing room password", err)
+	}
+	return hash
+}
+
+// passwordDigest boils the password down first since
+// bcrypt only looks at the first 72 bytes of whatever it's given
+func passwordDigest(password string) []byte {
+
+	sum := sha256.Sum256([]byte(password))
+	return []byte(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// buildRoom puts together an empty room with a fresh game
+// it isn't tracked or started until it's opened
+func buildRoom(code string, public bool) *Room {
+
+	newRoom := &Room{
+		ID:       code,
+		Public:   public,
+		Settings: DefaultSettings(),
+		// CurrGame: game,
+		checkin:    make(chan *Client),
+		checkout:   make(chan *Client),
+		publish:    make(chan interface{}),
+		commands:   make(chan interface{}),
+		snapshots:  make(chan chan RoomSnapshot),
+		releases:   make(chan chan struct{}),
+		done:       make(chan struct{}),
+		clients:    make(map[*Client]bool),
+		guests:     make(map[string]bool),
+		idle:       *roomIdle,
+		checkEvery: leaseCheck,
+	}
+
+	game := &Game{
+		Room: newRoom,
+	}
+	game.Reseed(time.Now().UnixNano())
+
+	newRoom.CurrGame = game
+
+	return newRoom
+}
+
+// open tracks the room and starts it up
+// unless someone already has the code
+func (room *Room) open() bool {
+
+	// the listing has to be there before anyone can find the room
+	room.tally()
+
+	// add room to the list of active rooms
+	// unless someone already has the code
+	if !hotel.Insert(room) {
+		return false
+	}
+
+	// or another instance does
+	sub, ok := room.claimCode()
+	if !ok {
+		hotel.Delete(room.ID)
+		return false
+	}
+	room.shareListing(room.Listing())
+
+	if room.Public {
+		room.shareChange()
+	}
+
+	// start the room in a routine
+	go room.run()
+	if sub != nil {
+		go room.host(sub)
+	}
+
+	return true
+}
+
+// validCode checks that a join code someone picked is sensible
+func validCode(code string) bool {
+
+	if len(code) < 3 || len(code) > 12 {
+		return false
+	}
+
+	for _, r := range code {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// newCode makes a random join code that is hard to guess
+func newCode() string {
+
+	code := make([]byte, codeLength)
+	max := big.NewInt(int64(len(codeLetters)))
+
+	for i := range code {
+
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			log.Fatalln("Error generating a join code", err)
 		}
+		code[i] = codeLetters[n.Int64()]
+	}
+
+	return string(code)
+}
+
+// tally keeps a listing of the seats taken and how the game is going
+// so that it can be checked from outside the room's routine
+func (room *Room) tally() {
+
+	listing := Listing{
+		ID:            room.ID,
+		Players:       room.CurrGame.Players.Here(),
+		Spectators:    len(room.CurrGame.Spectators),
+		MaxPlayers:    room.Settings.MaxPlayers,
+		MaxSpectators: room.Settings.MaxSpectators,
+		Phase:         room.CurrGame.Phase(),
+		Mode:          room.Settings.Mode,
+	}
+
+	if listing == room.Listing() {
+		return
+	}
+	room.listing.Store(listing)
+	room.shareListing(listing)
+
+	if room.Public {
+		room.shareChange()
+	}
+}
+
+// Listing gets the latest listing for the room
+func (room *Room) Listing() Listing {
+
+	listing, _ := room.listing.Load().(Listing)
+	return listing
+}
+
+// HasSpace checks if there are any seats left for a new player or spectator
+// it goes off the listing since the settings can change inside the room
+func (room *Room) HasSpace(spectator bool) bool {
+
+	listing := room.Listing()
+
+	if spectator {
+		return listing.Spectators < listing.MaxSpectators
+	}
+	return listing.Players < listing.MaxPlayers
+}
+
+// deliver sends the message to every client in the room
+// this must only be called from the room's routine
+func (room *Room) deliver(message interface{}) {
+
+	fmt.Println("room sending to clients", message)
+	for client := range room.clients {
+		room.enqueue(client, message)
+	}
+}
+
+// deliverTo sends the message to a single client if they are still in the room
+// this must only be called from the room's routine
+func (room *Room) deliverTo(client *Client, message interface{}) {
+
+	if _, ok := room.clients[client]; ok {
+		room.enqueue(client, message)
+	}
+}
+
+// do hands a command to the room's routine
+// unless the room has already closed
+func (room *Room) do(command interface{}) {
+
+	select {
+	case room.commands <- command:
+	case <-room.done:
+	}
+}
+
+// kick removes a client from the room and closes their outbox
+// which in turn tears down their connection
+// this must only be called from the room's routine
+func (room *Room) kick(client *Client) {
+
+	if _, ok := room.clients[client]; ok {
+
+		delete(room.clients, client)
+		client.send.Close()
+	}
+}
+
+// enqueue queues up the message for the client's writer without blocking the room
+// what happens when the queue is full is up to the overflow policy
+func (room *Room) enqueue(client *Client, message interface{}) {
+
+	if !client.send.Push(message) {
+
+		log.Println("Client fell too far behind, dropping them from room", room.ID)
+		room.kick(client)
 	}
 }
 
@@ -149,14 +550,55 @@ func (room *Room) run() {
 
 // Room is the game room for the clients to play in
 type Room struct {
-	ID       int64
+	ID       string
 	CurrGame *Game
+	Public   bool
+	listing  atomic.Value
 	clients  map[*Client]bool
 	checkin  chan *Client
 	checkout chan *Client
 	publish  chan interface{}
+	commands chan interface{}
+	done     chan struct{}
+
+	// how long the room stays open once everyone has left
+	// and how often its claim on the code is renewed or checked on
+	idle       time.Duration
+	checkEvery time.Duration
+
+	// asks the room for a copy of itself to save
+	// and to give up its code as the server shuts down
+	snapshots chan chan RoomSnapshot
+	releases  chan chan struct{}
+
+	// the settings are only ever changed by the room's routine
+	Settings RoomSettings
+
+	// the password is stored salted and hashed and the guest list
+	// holds everyone who has gotten past it
+	password []byte
+	mu       sync.Mutex
+	guests   map[string]bool
+
+	// claim is what this instance put in the backend for the room
+	// it's only touched by the room's routine once the room is open
+	// rooms hosted on another instance are relayed to the owner instead
+	claim string
+	owner string
+}
+
+// Listing is how a room shows up in the lobby
+type Listing struct {
+	ID            string `json:"id"`
+	Players       int    `json:"players"`
+	Spectators    int    `json:"spectators"`
+	MaxPlayers    int    `json:"maxPlayers"`
+	MaxSpectators int    `json:"maxSpectators"`
+	Phase         Phase  `json:"phase"`
+	Mode          Mode   `json:"mode"`
 }
 
+// empty checks if there are any clients left in the room
 func (room *Room) empty() bool {
 	return len(room.clients) == 0
 }
@@ -0,0 +1,777 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialRoom connects a test client to the room over a websocket
+// along with any extra name=value cookies, all of them signed
+// the uid gets a session the same as going through the join page
+func dialRoom(server *httptest.Server, room *Room, uid string, cookies ...string) (*websocket.Conn, error) {
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + fmt.Sprintf("/ws/%v", room.ID)
+
+	sessions.Open(uid)
+
+	header := http.Header{}
+	header.Add("Cookie", fmt.Sprintf("uid=%v; guestname=%v", cookieKeys.sign("uid", uid), cookieKeys.sign("guestname", uid)))
+	for _, cookie := range cookies {
+		parts := strings.SplitN(cookie, "=", 2)
+		header.Add("Cookie", parts[0]+"="+cookieKeys.sign(parts[0], parts[1]))
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	return conn, err
+}
+
+func TestIdleRoomCloses(t *testing.T) {
+
+	before := atomic.LoadInt64(&closedRooms)
+
+	room := buildRoom(newCode(), false)
+	room.idle = time.Millisecond * 50
+	if !room.open() {
+		t.Fatal("Expected", "the room to open", "got", "its code taken")
+	}
+
+	select {
+	case <-room.done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected", "the empty room to close", "got", "it still open")
+	}
+
+	if _, ok := hotel.Get(room.ID); ok {
+		t.Error("Expected", "the room to leave the hotel", "got", "it still there")
+	}
+	if closed := atomic.LoadInt64(&closedRooms); closed != before+1 {
+		t.Error("Expected", before+1, "closed rooms got", closed)
+	}
+}
+
+func TestGameCommandsSerialized(t *testing.T) {
+
+	server := httptest.NewServer(RequireSession(socketHandler, refuseSocket))
+	defer server.Close()
+
+	room := CreateRoom("", false)
+
+	var conns []*websocket.Conn
+	var envs []<-chan received
+	for _, uid := range []string{"serial-one", "serial-two", "serial-three"} {
+
+		conn, err := dialRoom(server, room, uid)
+		if err != nil {
+			t.Fatal("Error dialing room", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+		envs = append(envs, listen(conn))
+	}
+
+	// everyone submits and chats at the same time while one player starts
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+
+		wg.Add(1)
+		go func(i int, conn *websocket.Conn) {
+			defer wg.Done()
+
+			conn.WriteJSON(Envelope{
+				Type: "submit",
+				Body: map[string]string{"person": "dumbledore", "place": "hogwarts", "thing": "wand"},
+			})
+			if i == 0 {
+				conn.WriteJSON(Envelope{Type: "start"})
+			}
+			conn.WriteJSON(Envelope{
+				Type: "message",
+				Body: map[string]string{"message": "wand"},
+			})
+		}(i, conn)
+	}
+	wg.Wait()
+
+	for _, envs := range envs {
+		await(t, envs, "start", nil)
+	}
+
+	// every submission lands in the bowl even while the game gets going
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+
+		snapshot, ok := room.Snapshot()
+		if !ok {
+			t.Fatal("Expected", "a snapshot", "got", "a closed room")
+		}
+
+		nouns := len(snapshot.Game.Nouns.All) + len(snapshot.Game.Nouns.Guessed)
+		if nouns == 9 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected", 9, "nouns got", nouns)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestBackToBackDelivery(t *testing.T) {
+
+	server := httptest.NewServer(RequireSession(socketHandler, refuseSocket))
+	defer server.Close()
+
+	room := CreateRoom("", false)
+
+	conn, err := dialRoom(server, room, "rapid-fire")
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer conn.Close()
+
+	// the join announcement and the state snapshot come first
+	for _, expected := range []string{"action", "state"} {
+
+		env := struct{ Type string }{}
+		if err := conn.ReadJSON(&env); err != nil || env.Type != expected {
+			t.Fatal("Expected", expected, "got", env.Type, err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		room.publish <- &Guess{Text: fmt.Sprint(i)}
+	}
+
+	for i := 0; i < 10; i++ {
+
+		env := struct {
+			Type string
+			Body Guess
+		}{}
+
+		conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+		if err := conn.ReadJSON(&env); err != nil {
+			t.Fatal("Expected", "guess", i, "got", err)
+		}
+		if env.Body.Text != fmt.Sprint(i) {
+			t.Error("Expected", i, "got", env.Body.Text)
+		}
+	}
+}
+
+func TestReconnectKeepsSeat(t *testing.T) {
+
+	server := httptest.NewServer(RequireSession(socketHandler, refuseSocket))
+	defer server.Close()
+
+	room := CreateRoom("", false)
+
+	first, err := dialRoom(server, room, "comeback")
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer first.Close()
+
+	// a page refresh opens a second socket with the same uid
+	second, err := dialRoom(server, room, "comeback")
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer second.Close()
+
+	env := struct {
+		Type string
+		Body State
+	}{}
+
+	second.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if err := second.ReadJSON(&env); err != nil {
+		t.Fatal("Expected", "state", "got", err)
+	}
+
+	if env.Type != "state" {
+		t.Error("Expected", "state", "got", env.Type)
+	}
+	if len(env.Body.Players) != 1 {
+		t.Error("Expected", "1 player", "got", len(env.Body.Players))
+	}
+
+	// the old socket gets closed once the seat is taken over
+	first.SetReadDeadline(time.Now().Add(time.Second * 2))
+	for {
+		if _, _, err := first.ReadMessage(); err != nil {
+			if _, ok := err.(*websocket.CloseError); !ok {
+				t.Error("Expected", "close", "got", err)
+			}
+			break
+		}
+	}
+}
+
+func TestLateJoinerGetsState(t *testing.T) {
+
+	server := httptest.NewServer(RequireSession(socketHandler, refuseSocket))
+	defer server.Close()
+
+	room := CreateRoom("", false)
+
+	early, err := dialRoom(server, room, "early-bird")
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer early.Close()
+
+	early.WriteJSON(Envelope{
+		Type: "submit",
+		Body: map[string]string{"person": "dumbledore", "place": "hogwarts", "thing": "wand"},
+	})
+	early.WriteJSON(Envelope{Type: "start"})
+
+	// wait for the game to get going
+	early.SetReadDeadline(time.Now().Add(time.Second * 2))
+	for {
+		env := struct{ Type string }{}
+		if err := early.ReadJSON(&env); err != nil {
+			t.Fatal("Expected", "start", "got", err)
+		}
+		if env.Type == "start" {
+			break
+		}
+	}
+
+	// the only player is presenting so this is a hint
+	early.WriteJSON(Envelope{Type: "message", Body: map[string]string{"message": "wizard"}})
+	for {
+		env := struct{ Type string }{}
+		if err := early.ReadJSON(&env); err != nil {
+			t.Fatal("Expected", "hint", "got", err)
+		}
+		if env.Type == "hint" {
+			break
+		}
+	}
+
+	late, err := dialRoom(server, room, "late-comer")
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer late.Close()
+
+	late.SetReadDeadline(time.Now().Add(time.Second * 2))
+	for {
+		env := received{}
+		if err := late.ReadJSON(&env); err != nil {
+			t.Fatal("Expected", "state", "got", err)
+		}
+		if env.Type != "state" {
+			continue
+		}
+
+		// the hints can't give the answer away either
+		for _, text := range []string{"dumbledore", "hogwarts", "wand"} {
+			if strings.Contains(strings.ToLower(string(env.Body)), `"`+text+`"`) {
+				t.Error("Expected", "no nouns in a guesser's state", "got", string(env.Body))
+			}
+		}
+
+		var state State
+		if err := json.Unmarshal(env.Body, &state); err != nil {
+			t.Fatal("Error decoding state", err)
+		}
+		if len(state.Hints) != 1 || state.Hints[0].Text != "wizard" || state.Hints[0].Type != state.NounType {
+			t.Error("Expected", "the wizard hint", "got", state.Hints)
+		}
+
+		if state.Phase != Playing {
+			t.Error("Expected", Playing, "got", state.Phase)
+		}
+		if len(state.Players) != 2 {
+			t.Error("Expected", "2 players", "got", len(state.Players))
+		}
+		if state.NounType == "" {
+			t.Error("Expected", "a noun type", "got", "nothing")
+		}
+		if state.Noun != nil {
+			t.Error("Expected", "no noun for a guesser", "got", state.Noun)
+		}
+		break
+	}
+}
+
+// received is an envelope as the browser sees it
+type received struct {
+	Type string
+	Body json.RawMessage
+}
+
+// listen reads everything sent to the conn onto a channel
+func listen(conn *websocket.Conn) <-chan received {
+
+	envs := make(chan received, 64)
+	go func() {
+		defer close(envs)
+		for {
+			env := received{}
+			if err := conn.ReadJSON(&env); err != nil {
+				return
+			}
+			envs <- env
+		}
+	}()
+	return envs
+}
+
+// await waits for an envelope of the type that passes the check
+func await(t *testing.T, envs <-chan received, kind string, check func(body json.RawMessage) bool) {
+
+	timeout := time.After(time.Second * 2)
+	for {
+		select {
+		case env, ok := <-envs:
+			if !ok {
+				t.Fatal("Expected", kind, "got", "closed connection")
+			}
+			if env.Type == kind && (check == nil || check(env.Body)) {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Expected", kind, "got", "timeout")
+		}
+	}
+}
+
+func TestPresenterHandOff(t *testing.T) {
+
+	server := httptest.NewServer(RequireSession(socketHandler, refuseSocket))
+	defer server.Close()
+
+	room := CreateRoom("", false)
+
+	uids := []string{"handoff-one", "handoff-two"}
+	conns := map[string]*websocket.Conn{}
+	envs := map[string]<-chan received{}
+	for _, uid := range uids {
+
+		conn, err := dialRoom(server, room, uid)
+		if err != nil {
+			t.Fatal("Error dialing room", err)
+		}
+		defer conn.Close()
+		conns[uid] = conn
+		envs[uid] = listen(conn)
+	}
+
+	conns[uids[0]].WriteJSON(Envelope{
+		Type: "submit",
+		Body: map[string]string{"person": "dumbledore", "place": "hogwarts", "thing": "wand"},
+	})
+	conns[uids[0]].WriteJSON(Envelope{Type: "start"})
+
+	// whoever gets the noun right after the start is presenting
+	presenting := func(envs <-chan received) bool {
+
+		await(t, envs, "start", nil)
+		select {
+		case env := <-envs:
+			return env.Type == "noun"
+		case <-time.After(time.Millisecond * 300):
+			return false
+		}
+	}
+
+	presenter, other := uids[0], uids[1]
+	if !presenting(envs[uids[0]]) {
+		presenter, other = uids[1], uids[0]
+	}
+
+	// the presenter walks away
+	conns[presenter].Close()
+
+	await(t, envs[other], "state", func(body json.RawMessage) bool {
+
+		state := State{}
+		json.Unmarshal(body, &state)
+
+		return state.Presenter != nil && state.Presenter.ID == PlayerID(other) && state.Noun != nil
+	})
+}
+
+func TestStartSkipsPlayersWhoLeft(t *testing.T) {
+
+	// every seed shuffles the seats differently
+	for seed := int64(0); seed < 20; seed++ {
+
+		room := buildRoom(newCode(), false)
+		room.Settings.Teams = 2
+		g := room.CurrGame
+		g.Reseed(seed)
+
+		clients := []*Client{}
+		for _, name := range []string{"Ann", "Bob", "Cat", "Dan"} {
+			c := &Client{UserID: name, ID: PlayerID(name), Name: name}
+			clients = append(clients, c)
+			g.Join(c)
+		}
+		g.Leave(clients[1])
+
+		g.Do(Submission{Nouns: []Noun{{Person, "houdini"}, {Place, "narnia"}, {Thing, "kazoo"}}, client: clients[0]})
+		g.Do(Start{})
+
+		if g.Presenter == nil || g.Presenter.Away {
+			t.Fatal("Expected", "a presenter who is here", "got", g.Presenter)
+		}
+		if g.Players.All[g.Players.Current] != g.Presenter {
+			t.Error("Expected", "turns to start from the presenter", "got", g.Players.Current)
+		}
+
+		teams := map[int]int{}
+		for _, p := range g.Players.All {
+			if p.Away && p.Team != 0 {
+				t.Error("Expected", "no team for", p.Name, "got", p.Team)
+			}
+			teams[p.Team]++
+		}
+		if teams[1] != 2 || teams[2] != 1 {
+			t.Error("Expected", "the three still here split up", "got", teams)
+		}
+	}
+}
+
+func TestStartNeedsSomeoneHere(t *testing.T) {
+
+	room := buildRoom(newCode(), false)
+	g := room.CurrGame
+
+	ann := &Client{UserID: "ann", ID: PlayerID("ann"), Name: "Ann"}
+	g.Join(ann)
+	g.Do(Submission{Nouns: []Noun{{Person, "houdini"}, {Place, "narnia"}, {Thing, "kazoo"}}, client: ann})
+	g.Leave(ann)
+	g.Do(Start{})
+
+	if g.IsStarted || g.Presenter != nil {
+		t.Error("Expected", "the game to wait for someone", "got", g.Presenter)
+	}
+}
+
+func TestSpectatorOnlyWatches(t *testing.T) {
+
+	server := httptest.NewServer(RequireSession(socketHandler, refuseSocket))
+	defer server.Close()
+
+	room := CreateRoom("", false)
+
+	player, err := dialRoom(server, room, "spectate-player")
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer player.Close()
+	players := listen(player)
+
+	watcher, err := dialRoom(server, room, "spectate-watcher", "spectator=true")
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer watcher.Close()
+	watchers := listen(watcher)
+
+	await(t, watchers, "state", func(body json.RawMessage) bool {
+
+		state := State{}
+		json.Unmarshal(body, &state)
+
+		return state.Spectating && state.Spectators == 1 && len(state.Players) == 1
+	})
+
+	// the spectator's guess goes nowhere while the player's guess reaches everyone
+	watcher.WriteJSON(Envelope{Type: "message", Body: map[string]string{"message": "peeking"}})
+	player.WriteJSON(Envelope{Type: "message", Body: map[string]string{"message": "playing"}})
+
+	for _, envs := range []<-chan received{players, watchers} {
+		await(t, envs, "guess", func(body json.RawMessage) bool {
+
+			guess := Guess{}
+			json.Unmarshal(body, &guess)
+
+			if guess.Text == "peeking" {
+				t.Error("Expected", "spectator guesses to be ignored", "got", guess.Text)
+			}
+			return guess.Text == "playing"
+		})
+	}
+}
+
+func TestFullRoomTurnsClientsAway(t *testing.T) {
+
+	server := httptest.NewServer(RequireSession(socketHandler, refuseSocket))
+	defer server.Close()
+
+	limit := *maxPlayers
+	*maxPlayers = 1
+	room := CreateRoom("", false)
+	*maxPlayers = limit
+
+	first, err := dialRoom(server, room, "full-first")
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer first.Close()
+	await(t, listen(first), "state", nil)
+
+	second, err := dialRoom(server, room, "full-second")
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer second.Close()
+
+	second.SetReadDeadline(time.Now().Add(time.Second * 2))
+	_, _, err = second.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Error("Expected", "try again later", "got", err)
+	}
+
+	if room.HasSpace(false) {
+		t.Error("Expected", "no space for players", "got", "space")
+	}
+	if !room.HasSpace(true) {
+		t.Error("Expected", "space for spectators", "got", "none")
+	}
+}
+
+func TestLeavingFreesSeats(t *testing.T) {
+
+	room := buildRoom(newCode(), false)
+	room.Settings.MaxPlayers = 2
+	g := room.CurrGame
+
+	ann := &Client{UserID: room.ID + "-ann", ID: PlayerID(room.ID + "-ann"), Name: "Ann", send: NewOutbox(64, DropOldest)}
+	bob := &Client{UserID: room.ID + "-bob", ID: PlayerID(room.ID + "-bob"), Name: "Bob", send: NewOutbox(64, DropOldest)}
+	cat := &Client{UserID: room.ID + "-cat", ID: PlayerID(room.ID + "-cat"), Name: "Cat", send: NewOutbox(64, DropOldest)}
+
+	for _, c := range []*Client{ann, bob} {
+		if err := g.Admit(c); err != nil {
+			t.Fatal("Expected", "a seat", "got", err)
+		}
+		g.Join(c)
+	}
+	g.Leave(ann)
+	g.Leave(bob)
+
+	room.tally()
+	if players := room.Listing().Players; players != 0 {
+		t.Error("Expected", 0, "players listed got", players)
+	}
+
+	// a newcomer gets one of the seats they left behind
+	if err := g.Admit(cat); err != nil {
+		t.Fatal("Expected", "a seat", "got", err)
+	}
+	g.Join(cat)
+
+	// so the first one back gets the other one and the next is turned away
+	if err := g.Admit(ann); err != nil {
+		t.Error("Expected", "a seat", "got", err)
+	}
+	g.Join(ann)
+	if err := g.Admit(bob); err != ErrNoPlayerSpace {
+		t.Error("Expected", ErrNoPlayerSpace, "got", err)
+	}
+}
+
+func TestPrivateRoom(t *testing.T) {
+
+	server := httptest.NewServer(RequireSession(socketHandler, refuseSocket))
+	defer server.Close()
+
+	room := CreateRoom("secret", false)
+
+	if len(room.ID) != codeLength || strings.Trim(room.ID, codeLetters) != "" {
+		t.Error("Expected", "a join code", "got", room.ID)
+	}
+	if found, ok := GetRoom(strings.ToLower(room.ID)); !ok || found != room {
+		t.Error("Expected", "to find the room by its code", "got", found)
+	}
+
+	// the same password never hashes the same way twice
+	if other := CreateRoom("secret", false); bytes.Equal(other.password, room.password) {
+		t.Error("Expected", "salted passwords", "got", string(room.password))
+	}
+
+	// strangers get the door shut on them
+	stranger, err := dialRoom(server, room, "private-stranger")
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer stranger.Close()
+
+	stranger.SetReadDeadline(time.Now().Add(time.Second * 2))
+	_, _, err = stranger.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Error("Expected", "policy violation", "got", err)
+	}
+
+	if err := room.LetIn("private-guest", "guess"); err != ErrWrongPassword {
+		t.Error("Expected", ErrWrongPassword, "got", err)
+	}
+	if err := room.LetIn("private-guest", "secret"); err != nil {
+		t.Fatal("Expected", "to be let in", "got", err)
+	}
+
+	guest, err := dialRoom(server, room, "private-guest")
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer guest.Close()
+	await(t, listen(guest), "state", nil)
+}
+
+func TestGenerateRoomPathValidatesRooms(t *testing.T) {
+
+	// a fresh code each run so repeated runs don't trip over each other
+	code := newCode()
+
+	form := url.Values{}
+	form.Set("room", strings.ToLower(code))
+
+	if _, err := GenerateRoomPath(form, "validate-guest"); err != ErrNoSuchRoom {
+		t.Error("Expected", ErrNoSuchRoom, "got", err)
+	}
+
+	// taking them up on the offer to create it
+	form.Set("create", "true")
+
+	route, err := GenerateRoomPath(form, "validate-guest")
+	if err != nil || route != "/room/"+code {
+		t.Error("Expected", "/room/"+code, "got", route, err)
+	}
+
+	if _, err := GenerateRoomPath(form, "validate-guest"); err != ErrRoomTaken {
+		t.Error("Expected", ErrRoomTaken, "got", err)
+	}
+
+	form.Set("room", "no way!")
+	if _, err := GenerateRoomPath(form, "validate-guest"); err != ErrBadRoomName {
+		t.Error("Expected", ErrBadRoomName, "got", err)
+	}
+}
+
+func TestJoinOffersToCreateMissingRoom(t *testing.T) {
+
+	form := url.Values{}
+	form.Set("guestname", "<b>typo</b>")
+	form.Set("room", "typo99")
+
+	req := httptest.NewRequest(http.MethodPost, "/join", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res := httptest.NewRecorder()
+
+	joinHandler(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Error("Expected", http.StatusOK, "got", res.Code)
+	}
+
+	body := res.Body.String()
+	if !strings.Contains(body, "Create room TYPO99") {
+		t.Error("Expected", "an offer to create the room", "got", body)
+	}
+	if strings.Contains(body, "<b>typo</b>") {
+		t.Error("Expected", "the guest name to be escaped", "got", body)
+	}
+}
+
+func TestHostChangesSettings(t *testing.T) {
+
+	server := httptest.NewServer(RequireSession(socketHandler, refuseSocket))
+	defer server.Close()
+
+	room := CreateRoom("", false)
+
+	host, err := dialRoom(server, room, room.ID+"-host")
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer host.Close()
+	hostEnvs := listen(host)
+
+	// the first player in is the host
+	await(t, hostEnvs, "state", func(body json.RawMessage) bool {
+		state := State{}
+		json.Unmarshal(body, &state)
+		return state.IsHost && state.Settings == DefaultSettings()
+	})
+
+	guest, err := dialRoom(server, room, room.ID+"-guest")
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer guest.Close()
+	guestEnvs := listen(guest)
+
+	await(t, guestEnvs, "state", func(body json.RawMessage) bool {
+		state := State{}
+		json.Unmarshal(body, &state)
+		return !state.IsHost && state.Host != nil && state.Host.ID == PlayerID(room.ID+"-host")
+	})
+
+	settings := DefaultSettings()
+	settings.Rounds = 5
+	settings.Teams = 2
+
+	// only the host gets to change anything
+	guest.WriteJSON(Envelope{Type: "settings", Body: settings})
+	await(t, guestEnvs, "settings", func(body json.RawMessage) bool {
+		update := SettingsUpdate{}
+		json.Unmarshal(body, &update)
+		return update.Error == ErrNotHost.Error() && update.Settings.Rounds == 3
+	})
+
+	// settings the room can't play with are turned down
+	settings.MaxPlayers = 1
+	host.WriteJSON(Envelope{Type: "settings", Body: settings})
+	await(t, hostEnvs, "settings", func(body json.RawMessage) bool {
+		update := SettingsUpdate{}
+		json.Unmarshal(body, &update)
+		return update.Error != "" && update.Settings.Rounds == 3
+	})
+
+	// and the ones that make sense go out to everyone
+	settings.MaxPlayers = 4
+	host.WriteJSON(Envelope{Type: "settings", Body: settings})
+	for _, envs := range []<-chan received{hostEnvs, guestEnvs} {
+		await(t, envs, "settings", func(body json.RawMessage) bool {
+			update := SettingsUpdate{}
+			json.Unmarshal(body, &update)
+			return update.Error == "" && update.Settings == settings
+		})
+	}
+
+	// the lobby sees the new seat limit
+	time.Sleep(100 * time.Millisecond)
+	if listing := room.Listing(); listing.MaxPlayers != 4 {
+		t.Error("Expected", 4, "got", listing.MaxPlayers)
+	}
+
+	// nothing changes once the game is going
+	host.WriteJSON(Envelope{
+		Type: "submit",
+		Body: map[string]string{"person": "dumbledore", "place": "hogwarts", "thing": "wand"},
+	})
+	host.WriteJSON(Envelope{Type: "start"})
+	host.WriteJSON(Envelope{Type: "settings", Body: DefaultSettings()})
+	await(t, hostEnvs, "settings", func(body json.RawMessage) bool {
+		update := SettingsUpdate{}
+		json.Unmarshal(body, &update)
+		return update.Error == ErrAlreadyStarted.Error() && update.Settings == settings
+	})
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+//***********************************************************************************************
+//
+// External
+//
+//***********************************************************************************************
+
+// NewSessionStore builds an empty session store
+// nothing expires until the store is started
+func NewSessionStore() *SessionStore {
+
+	return &SessionStore{
+		sessions: make(map[string]*Session),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// Start runs the expiry worker in the background which every so often
+// removes the sessions that have been idle longer than maxIdle
+// and lets the other instances know which ones are still going
+func (s *SessionStore) Start(every time.Duration, maxIdle time.Duration) {
+
+	s.start.Do(func() {
+
+		s.mu.Lock()
+		s.maxIdle = maxIdle
+		s.mu.Unlock()
+
+		go s.expire(every, maxIdle)
+	})
+}
+
+// Close stops the expiry worker and waits for it to finish
+// it's safe to call more than once or on a store that was never started
+func (s *SessionStore) Close() {
+
+	s.close.Do(func() {
+		close(s.stop)
+	})
+
+	// a store that never started has nothing to wait on
+	s.start.Do(func() {
+		close(s.stopped)
+	})
+	<-s.stopped
+}
+
+// Get finds the session for a user id
+func (s *SessionStore) Get(uid string) (*Session, bool) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session, ok := s.sessions[uid]
+	return session, ok
+}
+
+// Put adds or replaces the session for a user id
+func (s *SessionStore) Put(uid string, session *Session) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[uid] = session
+}
+
+// Open starts a fresh session for the user id or bumps out the one they have
+// it's shared straight away so any instance can pick it up
+func (s *SessionStore) Open(uid string) {
+
+	s.mu.Lock()
+	s.sessions[uid] = &Session{lastActivity: time.Now()}
+	ttl := s.maxIdle
+	s.mu.Unlock()
+
+	if err := backend.Set(sessionKey(uid), "true", ttl); err != nil {
+		log.Println("Error sharing session", err)
+	}
+}
+
+// Active checks the user id still has a session and marks it active
+// a session opened on another instance gets picked up here
+func (s *SessionStore) Active(uid string) bool {
+
+	if s.Touch(uid) {
+		return true
+	}
+
+	_, ok, err := backend.Get(sessionKey(uid))
+	if err != nil {
+		log.Println("Error checking shared session", err)
+	}
+	if ok {
+		s.Put(uid, &Session{lastActivity: time.Now()})
+	}
+	return ok
+}
+
+// Touch marks the session as active right now
+// and reports whether there was one to mark
+func (s *SessionStore) Touch(uid string) bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[uid]
+	if ok {
+		session.lastActivity = time.Now()
+	}
+	return ok
+}
+
+// Expire removes every session that has been idle longer than maxIdle
+// and hands back how many it removed
+func (s *SessionStore) Expire(maxIdle time.Duration) int {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for uid, session := range s.sessions {
+
+		if time.Since(session.lastActivity) > maxIdle {
+			delete(s.sessions, uid)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Delete removes the session for a user id
+func (s *SessionStore) Delete(uid string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, uid)
+}
+
+// Range calls f for every session in the store until f returns false
+// the sessions are copied out first so f is free to modify the store
+func (s *SessionStore) Range(f func(uid string, session *Session) bool) {
+
+	s.mu.RLock()
+	uids := make([]string, 0, len(s.sessions))
+	all := make([]*Session, 0, len(s.sessions))
+	for uid, session := range s.sessions {
+		uids = append(uids, uid)
+		all = append(all, session)
+	}
+	s.mu.RUnlock()
+
+	for i := range uids {
+		if !f(uids[i], all[i]) {
+			return
+		}
+	}
+}
+
+// Len counts the sessions in the store
+func (s *SessionStore) Len() int {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.sessions)
+}
+
+//***********************************************************************************************
+//
+// Internal
+//
+//***********************************************************************************************
+
+// expire is the expiry worker, it runs until the store is closed
+func (s *SessionStore) expire(every time.Duration, maxIdle time.Duration) {
+
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+
+		case <-ticker.C:
+			if removed := s.Expire(maxIdle); removed > 0 {
+				log.Println("Removed", removed, "old sessions..")
+			}
+			s.share(maxIdle)
+
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// share pushes out the shared expiry of every session still going here
+// so it lasts as long as the session has left on this instance
+func (s *SessionStore) share(maxIdle time.Duration) {
+
+	s.mu.RLock()
+	left := make(map[string]time.Duration, len(s.sessions))
+	for uid, session := range s.sessions {
+		left[uid] = maxIdle - time.Since(session.lastActivity)
+	}
+	s.mu.RUnlock()
+
+	for uid, ttl := range left {
+		if ttl <= 0 {
+			continue
+		}
+		if err := backend.Set(sessionKey(uid), "true", ttl); err != nil {
+			log.Println("Error sharing session", err)
+			return
+		}
+	}
+}
+
+// sessionKey is where a session is shared with the other instances
+// the uid is hashed the same as on the guest lists
+func sessionKey(uid string) string {
+
+	return backendPrefix + "session:" + PlayerID(uid)
+}
+
+//***********************************************************************************************
+//
+// Structs
+//
+//***********************************************************************************************
+
+// SessionStore keeps track of all the open sessions
+// and is safe to use from multiple routines
+type SessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+	maxIdle  time.Duration
+	start    sync.Once
+	close    sync.Once
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// Session tracks the time a visitor was last active
+// the last activity is guarded by the store's lock
+type Session struct {
+	lastActivity time.Time
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Limits on what the host can pick for the room
+const (
+	minRounds       = 1
+	maxRounds       = 10
+	maxStartingTime = 30
+	maxTeams        = 4
+	minPlayers      = 2
+)
+
+// Reasons the host's settings get turned down
+var (
+	ErrNotHost         = errors.New("Only the host can change the settings.")
+	ErrAlreadyStarted  = errors.New("The settings can't be changed once the game has started.")
+	ErrUnknownMode     = errors.New("We don't know how to play that mode.")
+	ErrTooManyInRoom   = errors.New("There are already more players here than that.")
+	ErrTooManyWatching = errors.New("There are already more spectators here than that.")
+)
+
+//***********************************************************************************************
+//
+// External
+//
+//***********************************************************************************************
+
+// DefaultSettings are what every room starts out with
+// the seat limits come from the flags
+func DefaultSettings() RoomSettings {
+
+	return RoomSettings{
+		Mode:          Classic,
+		Rounds:        3,
+		StartingTime:  3,
+		Teams:         0,
+		MaxPlayers:    *maxPlayers,
+		MaxSpectators: *maxSpectators,
+	}
+}
+
+// Validate checks the settings are something the room can actually play with
+// the seat limits can't go past the flags the server was started with
+func (s RoomSettings) Validate() error {
+
+	if s.Mode != Classic {
+		return ErrUnknownMode
+	}
+
+	if s.Rounds < minRounds || s.Rounds > maxRounds {
+		return fmt.Errorf("Rounds need to be between %v and %v.", minRounds, maxRounds)
+	}
+
+	if s.StartingTime < 0 || s.StartingTime > maxStartingTime {
+		return fmt.Errorf("The starting time needs to be between 0 and %v seconds.", maxStartingTime)
+	}
+
+	// one team would just be everyone for themselves
+	if s.Teams < 0 || s.Teams == 1 || s.Teams > maxTeams {
+		return fmt.Errorf("Teams need to be 0 or between 2 and %v.", maxTeams)
+	}
+
+	if s.MaxPlayers < minPlayers || s.MaxPlayers > *maxPlayers {
+		return fmt.Errorf("Max players needs to be between %v and %v.", minPlayers, *maxPlayers)
+	}
+
+	if s.Teams > s.MaxPlayers {
+		return fmt.Errorf("There need to be at least as many seats as teams.")
+	}
+
+	if s.MaxSpectators < 0 || s.MaxSpectators > *maxSpectators {
+		return fmt.Errorf("Max spectators needs to be between 0 and %v.", *maxSpectators)
+	}
+
+	return nil
+}
+
+//***********************************************************************************************
+//
+// Structs
+//
+//***********************************************************************************************
+
+// RoomSettings are the rules the host picks for the room
+// the starting time is in seconds and teams of 0 means no teams
+type RoomSettings struct {
+	Mode          Mode `json:"mode"`
+	Rounds        int  `json:"rounds"`
+	StartingTime  int  `json:"startingTime"`
+	Teams         int  `json:"teams"`
+	MaxPlayers    int  `json:"maxPlayers"`
+	MaxSpectators int  `json:"maxSpectators"`
+}
+
+// ChangeSettings struct carries the settings a player
+// sent in so the game can check they're the host
+type ChangeSettings struct {
+	Settings RoomSettings
+	client   *Client
+}
+
+// SettingsUpdate struct is the settings the room is playing with
+// along with why the host's last change was turned down if it was
+type SettingsUpdate struct {
+	Settings RoomSettings `json:"settings"`
+	Error    string       `json:"error,omitempty"`
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestSettingsValidate(t *testing.T) {
+
+	if err := DefaultSettings().Validate(); err != nil {
+		t.Error("Expected", nil, "got", err)
+	}
+
+	bad := map[string]func(s *RoomSettings){
+		"unknown mode":      func(s *RoomSettings) { s.Mode = "speed" },
+		"no rounds":         func(s *RoomSettings) { s.Rounds = 0 },
+		"too many rounds":   func(s *RoomSettings) { s.Rounds = maxRounds + 1 },
+		"negative start":    func(s *RoomSettings) { s.StartingTime = -1 },
+		"one team":          func(s *RoomSettings) { s.Teams = 1 },
+		"too many teams":    func(s *RoomSettings) { s.Teams = maxTeams + 1 },
+		"more teams":        func(s *RoomSettings) { s.Teams = 3; s.MaxPlayers = 2 },
+		"lonely room":       func(s *RoomSettings) { s.MaxPlayers = 1 },
+		"past the flag":     func(s *RoomSettings) { s.MaxPlayers = *maxPlayers + 1 },
+		"too many watching": func(s *RoomSettings) { s.MaxSpectators = *maxSpectators + 1 },
+	}
+
+	for name, change := range bad {
+
+		settings := DefaultSettings()
+		change(&settings)
+
+		if err := settings.Validate(); err == nil {
+			t.Error("Expected", name, "to be turned down got", settings)
+		}
+	}
+}
@@ -10,8 +10,10 @@ $(document).ready(function () {
         
         if (window['WebSocket']) {
     
+            // replays point us at their own socket
             let room = window.location.pathname.split('/').slice(-1).pop();
-            this.conn = new WebSocket('ws://' + document.location.host + '/ws/' + room);
+            let path = window.socketPath || '/ws/' + room;
+            this.conn = new WebSocket('ws://' + document.location.host + path);
     
             this.conn.onopen = evt => {
 
@@ -30,6 +32,12 @@ $(document).ready(function () {
                 console.info('Websocket closed..', evt);
                 $('#conn-result').html('<i>Connection to host closed.</i>');
 
+                // the room has no space for us
+                if (evt.code == 1013) {
+                    window.location = '/join?full=' + room;
+                    return;
+                }
+
                 if (evt.code == 1006 && reconnect <= 5) {
                     reconnect++;
                     setTimeout(function(){ connect(); }, 2000);
@@ -67,6 +75,8 @@ $(document).ready(function () {
 
         $('.start-btn').hide();
         $('#loading-spinner').show();
+
+        // the host picks how long everyone gets to settle in
         setTimeout(() => {
 
             let envelope = JSON.stringify(
@@ -77,10 +87,32 @@ $(document).ready(function () {
         
             sendEnvelope(envelope);
 
-        }, 2000);
+        }, settings.startingTime * 1000);
 
     });
 
+    // button handler for saving the room settings
+    UIkit.util.on('#settings-save-btn', 'click', function (event) {
+
+        event.preventDefault();
+        event.target.blur();
+
+        let envelope = JSON.stringify(
+            {
+                type: "settings",
+                body: {
+                    mode: $('#settings-mode').val(),
+                    rounds: parseInt($('#settings-rounds').val(), 10),
+                    startingTime: parseInt($('#settings-starting-time').val(), 10),
+                    teams: parseInt($('#settings-teams').val(), 10),
+                    maxPlayers: parseInt($('#settings-max-players').val(), 10),
+                    maxSpectators: parseInt($('#settings-max-spectators').val(), 10),
+                },
+            });
+
+        sendEnvelope(envelope);
+    });
+
     // button handler for the player input text box
     UIkit.util.on('#player-send-btn', 'click', function (event) {
 
@@ -100,6 +132,15 @@ $(document).ready(function () {
         element.val('');
     });
 
+    // button handler for the presenter skipping their noun
+    UIkit.util.on('#pass-btn', 'click', function (event) {
+
+        event.preventDefault();
+        event.target.blur();
+
+        sendEnvelope(JSON.stringify({ type: "pass", body: {} }));
+    });
+
     // binds the enter key to the player input text box
     $(document).keypress(function(e){
         if (e.which == 13){
@@ -118,20 +159,12 @@ $(document).ready(function () {
 
             case 'hint':
 
-                $('#loading-spinner').hide();
-
-                $('#noun-type').html(data.noun.type);
-                $('#noun-hint').html(data.text);
-                $('#latest-hint').prop('hidden', false);
+                showHint(data);
                 break;
 
             case 'guess':
 
-                let side = false ? 'uk-float-right' : 'uk-float-left';
-                let guess = '<div class="uk-badge uk-padding-small '+side+'">'
-                    +data.text+'</div><br><br>';
-
-                $('#guess-list').prepend(guess);
+                addGuess(data);
 
                 if (data.isCorrect) {
                     
@@ -149,32 +182,101 @@ $(document).ready(function () {
                 
                 UIkit.modal.alert('Your noun is "'+ data.text +'"');
                 $('#current-noun').html(data.text);
+                $('#pass-btn').prop('hidden', false);
                 break;
 
             case 'action':
 
                 UIkit.notification({
-                    message: data.body,
+                    message: data.player.name + (data.action === 'leave' ? ' left' : ' joined'),
                     status: 'primary',
                     pos: 'top-right',
                     timeout: 1000
                 });
 
-                let alias = 
-                    data.player.name.slice(0, 2).toUpperCase();
+                // leaving players get redrawn by the state snapshot that follows
+                if (data.action === 'join') {
+                    addPlayerBadge(data.player);
+                }
+                break;
 
-                // upate player badge
-                let playerBadge = 
-                    '<div class="uk-icon-button uk-margin-small-left uk-margin-small-bottom" >'+alias+'</div>'; 
-                
-                $('#player-icons').append(playerBadge);
+            case 'settings':
+
+                showSettings(data.settings);
+
+                $('#settings-error').prop('hidden', !data.error);
+                $('#settings-error p').text(data.error || '');
+                break;
+
+            case 'state':
+
+                // rebuild everything from the snapshot
+                isHost = data.isHost;
+                showSettings(data.settings);
+                let presenter = data.presenter ? data.presenter.id : null;
+
+                $('#player-icons').empty();
+                data.players.forEach(player => {
+                    addPlayerBadge(player, player.id === presenter);
+                });
+
+                $('#guess-list').empty();
+                (data.guesses || []).forEach(addGuess);
+
+                let hints = data.hints || [];
+                if (hints.length > 0) {
+                    showHint(hints[hints.length - 1]);
+                }
+
+                if (data.phase === 'playing') {
+
+                    $('#game-round').html(data.round + ' of ' + data.settings.rounds);
+                    $('#settings-panel').hide();
+                    UIkit.modal($('#noun-submit-modal')).hide();
+                    $('.start-btn').hide();
+                    $('#loading-spinner').hide();
+                    $('#noun-type').html(data.nounType);
+                    startTimer(data.elapsed);
+                }
+
+                if (data.noun) {
+
+                    $('#current-noun').html(data.noun.text);
+                }
+                $('#pass-btn').prop('hidden', !data.noun);
+
+                // spectators only get to watch
+                if (data.spectating) {
 
+                    UIkit.modal($('#noun-submit-modal')).hide();
+                    $('.start-btn').hide();
+                    $('#player-input').hide();
+                }
+                break;
+
+            case 'over':
+
+                // show the final scores then start fresh for the next game
+                clearInterval(timer);
+
+                let scores = data.players
+                    .slice()
+                    .sort((a, b) => b.score - a.score)
+                    .map(player => $('<li>').text(player.name + ': ' + player.score).prop('outerHTML'))
+                    .join('');
+
+                UIkit.modal.alert(
+                    '<h3>Game over!</h3><ul class="uk-list">' + scores + '</ul>'
+                    + '<a href="/history/' + data.id + '">See how it went</a>'
+                ).then(() => window.location.reload());
                 break;
 
             case 'start':
 
+                $('#settings-panel').hide();
                 $('.start-btn').hide();
                 $('#loading-spinner').show();
+                startTimer(0);
                 break;
 
             default: 
@@ -184,6 +286,79 @@ $(document).ready(function () {
 
     }
 
+    // fills in the settings panel, only the host gets to change anything
+    let settings = { startingTime: 2 };
+    let isHost = false;
+    function showSettings(latest) {
+
+        settings = latest;
+
+        $('#settings-mode').val(settings.mode);
+        $('#settings-rounds').val(settings.rounds);
+        $('#settings-starting-time').val(settings.startingTime);
+        $('#settings-teams').val(settings.teams);
+        $('#settings-max-players').val(settings.maxPlayers);
+        $('#settings-max-spectators').val(settings.maxSpectators);
+
+        $('.settings-input').prop('disabled', !isHost);
+        $('#settings-save-btn').toggle(isHost);
+    }
+
+    // adds a badge with the players initials and score
+    function addPlayerBadge(player, isPresenter) {
+
+        let alias = 
+            player.name.slice(0, 2).toUpperCase();
+
+        let style = isPresenter ? ' uk-button-primary' : '';
+        if (player.away) {
+            style += ' uk-disabled';
+        }
+
+        let playerBadge = 
+            '<div class="uk-icon-button uk-margin-small-left uk-margin-small-bottom'+style+'" '
+            +'title="'+player.name+': '+(player.score || 0)+'" >'+alias+'</div>'; 
+        
+        $('#player-icons').append(playerBadge);
+    }
+
+    // shows the latest hint from the presenter
+    function showHint(hint) {
+
+        $('#loading-spinner').hide();
+
+        $('#noun-type').html(hint.type);
+        $('#noun-hint').html(hint.text);
+        $('#latest-hint').prop('hidden', false);
+    }
+
+    // adds a guess to the top of the list
+    function addGuess(guess) {
+
+        let side = false ? 'uk-float-right' : 'uk-float-left';
+        let badge = '<div class="uk-badge uk-padding-small '+side+'">'
+            +guess.text+'</div><br><br>';
+
+        $('#guess-list').prepend(badge);
+    }
+
+    // counts up the time since the game started
+    let timer;
+    function startTimer(elapsed) {
+
+        let started = Date.now() - (elapsed * 1000);
+
+        clearInterval(timer);
+        timer = setInterval(() => {
+
+            let seconds = Math.floor((Date.now() - started) / 1000);
+            let minutes = Math.floor(seconds / 60);
+            seconds = seconds % 60;
+
+            $('#game-timer').html(minutes + ':' + (seconds < 10 ? '0' : '') + seconds);
+        }, 1000);
+    }
+
     // starts the game
     function sendEnvelope(envelope) {
 
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//***********************************************************************************************
+//
+// External
+//
+//***********************************************************************************************
+
+// Store keeps the rooms somewhere that outlives the server
+type Store interface {
+	Save(rooms []RoomSnapshot) error
+	Load() ([]RoomSnapshot, error)
+}
+
+// NewFileStore builds a store that keeps every room in one json file
+func NewFileStore(path string) *FileStore {
+
+	return &FileStore{path: path}
+}
+
+// Save writes the rooms out to the file
+func (fs *FileStore) Save(rooms []RoomSnapshot) error {
+
+	data, err := json.Marshal(rooms)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(fs.path, data)
+}
+
+// Load reads the rooms back out of the file
+// a missing file just means there's nothing to restore yet
+func (fs *FileStore) Load() ([]RoomSnapshot, error) {
+
+	data, err := ioutil.ReadFile(fs.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var rooms []RoomSnapshot
+	if err := json.Unmarshal(data, &rooms); err != nil {
+		return nil, err
+	}
+	return rooms, nil
+}
+
+// SaveRooms takes a snapshot of every open room and puts them in the store
+func SaveRooms(store Store) error {
+
+	rooms := []RoomSnapshot{}
+
+	hotel.Range(func(room *Room) bool {
+
+		if snapshot, ok := room.Snapshot(); ok {
+			rooms = append(rooms, snapshot)
+		}
+		return true
+	})
+
+	return store.Save(rooms)
+}
+
+// RestoreRooms opens back up every room in the store
+// the players are kept away until they reconnect
+func RestoreRooms(store Store) (int, error) {
+
+	rooms, err := store.Load()
+	if err != nil {
+		return 0, err
+	}
+
+	restored := 0
+	for _, snapshot := range rooms {
+
+		if restoreRoom(snapshot) {
+			restored++
+		} else {
+			log.Println("Room", snapshot.ID, "is already open, skipping it")
+		}
+	}
+	return restored, nil
+}
+
+// Snapshot asks the room for a copy of itself that can be saved
+// closed rooms have nothing to save
+// and relays have nothing of their own to save
+func (room *Room) Snapshot() (RoomSnapshot, bool) {
+
+	if room.owner != "" {
+		return RoomSnapshot{}, false
+	}
+
+	reply := make(chan RoomSnapshot, 1)
+
+	select {
+	case room.snapshots <- reply:
+	case <-room.done:
+		return RoomSnapshot{}, false
+	}
+
+	return <-reply, true
+}
+
+//***********************************************************************************************
+//
+// Internal
+//
+//***********************************************************************************************
+
+// writeFile swaps the data in for whatever is in the file
+// it goes to a temp file first so a crash mid write never leaves half a file behind
+func writeFile(path string, data []byte) error {
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// keep saves the rooms every so often for as long as the server is up
+func keep(store Store, every time.Duration) {
+
+	for range time.Tick(every) {
+
+		if err := SaveRooms(store); err != nil {
+			log.Println("Error saving rooms", err)
+		}
+	}
+}
+
+// snapshot copies the room and its game
+// this must only be called from the room's routine
+func (room *Room) snapshot() RoomSnapshot {
+
+	snapshot := RoomSnapshot{
+		ID:       room.ID,
+		Public:   room.Public,
+		Password: room.password,
+		Settings: room.Settings,
+		Game:     room.CurrGame.snapshot(),
+	}
+
+	room.mu.Lock()
+	for uid := range room.guests {
+		snapshot.Guests = append(snapshot.Guests, uid)
+	}
+	room.mu.Unlock()
+
+	return snapshot
+}
+
+// snapshot copies everything the game needs to carry on later
+// spectators and connections don't survive a restart
+func (g *Game) snapshot() GameSnapshot {
+
+	snapshot := GameSnapshot{
+		Nouns:     Bowl{Current: g.Nouns.Current},
+		Turn:      g.Players.Current,
+		IsStarted: g.IsStarted,
+		StartedAt: g.StartedAt,
+		Round:     g.Round,
+		Played:    append([]NounRecord{}, g.Played...),
+		Events:    append([]Event{}, g.Events...),
+		Seed:      g.Seed,
+		Journal:   append([]Entry{}, g.Journal...),
+		Hints:     append([]Hint{}, g.Hints...),
+		Guesses:   append([]Guess{}, g.Guesses...),
+	}
+
+	snapshot.Nouns.All = append([]Noun{}, g.Nouns.All...)
+	snapshot.Nouns.Guessed = append([]Noun{}, g.Nouns.Guessed...)
+
+	for _, p := range g.Players.All {
+		snapshot.Players = append(snapshot.Players, PlayerSnapshot{
+			Player: p.ID,
+			Name:   p.Name,
+			Score:  p.Score,
+			Team:   p.Team,
+		})
+	}
+
+	if g.Host != nil {
+		snapshot.Host = g.Host.ID
+	}
+
+	return snapshot
+}
+
+// restoreRoom opens a room back up from its snapshot
+func restoreRoom(snapshot RoomSnapshot) bool {
+
+	room := unpackRoom(snapshot)
+
+	// the journal has everything that happened so the game is played
+	// back from the start, older saves only have the game as it was
+	if len(snapshot.Game.Journal) > 0 {
+
+		err := room.CurrGame.Rebuild(snapshot.Game.Journal)
+		if err == nil {
+			room.CurrGame.Restart()
+		} else {
+			log.Println("Room", snapshot.ID, "has a journal we can't use", err)
+			room = unpackRoom(snapshot)
+			room.CurrGame.restore(snapshot.Game)
+		}
+
+	} else {
+
+		room.CurrGame.restore(snapshot.Game)
+	}
+
+	// the flags might have tightened up since the room was saved
+	room.Settings = snapshot.Settings
+	if err := room.Settings.Validate(); err != nil {
+		log.Println("Room", snapshot.ID, "had settings we can't use anymore", err)
+		room.Settings = DefaultSettings()
+	}
+
+	return room.open()
+}
+
+// unpackRoom builds an empty room with the snapshot's password and guest list
+func unpackRoom(snapshot RoomSnapshot) *Room {
+
+	room := buildRoom(snapshot.ID, snapshot.Public)
+	room.password = snapshot.Password
+	room.CurrGame.Reseed(snapshot.Game.Seed)
+
+	for _, uid := range snapshot.Guests {
+		room.guests[uid] = true
+	}
+	return room
+}
+
+// restore puts the game back the way it was for saves without a journal
+// every player starts out away and nobody is presenting
+// so the first player back picks the game up again
+func (g *Game) restore(snapshot GameSnapshot) {
+
+	g.Nouns = snapshot.Nouns
+	g.IsStarted = snapshot.IsStarted
+	g.StartedAt = snapshot.StartedAt
+	g.Round = snapshot.Round
+	g.Played = snapshot.Played
+	g.Events = snapshot.Events
+	g.Hints = snapshot.Hints
+	g.Guesses = snapshot.Guesses
+
+	for _, ps := range snapshot.Players {
+
+		p := &Player{
+			Client: &Client{ID: seatedAs(ps.Player, ps.UserID), Name: ps.Name},
+			Score:  ps.Score,
+			Team:   ps.Team,
+			Away:   true,
+		}
+		g.Players.Add(p)
+
+		// older saves kept the host's user id too
+		if p.ID == snapshot.Host || (ps.UserID != "" && ps.UserID == snapshot.Host) {
+			g.Host = p
+		}
+	}
+	g.Players.Current = snapshot.Turn
+
+	if g.IsStarted && len(g.Nouns.All) > 0 {
+		g.CurrentNoun = &g.Nouns.All[g.Nouns.Current]
+	}
+}
+
+//***********************************************************************************************
+//
+// Structs
+//
+//***********************************************************************************************
+
+// FileStore keeps the rooms in a json file on disk
+type FileStore struct {
+	path string
+}
+
+// RoomSnapshot is everything about a room worth saving
+type RoomSnapshot struct {
+	ID       string       `json:"id"`
+	Public   bool         `json:"public"`
+	Password []byte       `json:"password,omitempty"`
+	Guests   []string     `json:"guests,omitempty"`
+	Settings RoomSettings `json:"settings"`
+	Game     GameSnapshot `json:"game"`
+}
+
+// GameSnapshot is everything about a game worth saving
+type GameSnapshot struct {
+	Players   []PlayerSnapshot `json:"players"`
+	Host      string           `json:"host"`
+	Turn      int              `json:"turn"`
+	Nouns     Bowl             `json:"nouns"`
+	IsStarted bool             `json:"isStarted"`
+	StartedAt time.Time        `json:"startedAt"`
+	Round     int              `json:"round"`
+	Played    []NounRecord     `json:"played"`
+	Events    []Event          `json:"events"`
+	Seed      int64            `json:"seed"`
+	Journal   []Entry          `json:"journal"`
+	Hints     []Hint           `json:"hints"`
+	Guesses   []Guess          `json:"guesses"`
+}
+
+// PlayerSnapshot is a player without their connection
+// older saves have the user id instead of the hashed one
+type PlayerSnapshot struct {
+	Player string `json:"player,omitempty"`
+	UserID string `json:"userID,omitempty"`
+	Name   string `json:"name"`
+	Score  int    `json:"score"`
+	Team   int    `json:"team"`
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRoomsSurviveRestart(t *testing.T) {
+
+	server := httptest.NewServer(RequireSession(socketHandler, refuseSocket))
+	defer server.Close()
+
+	room := CreateRoom("secret", false)
+	host, guest := room.ID+"-host", room.ID+"-guest"
+
+	for _, uid := range []string{host, guest} {
+
+		room.LetIn(uid, "secret")
+
+		conn, err := dialRoom(server, room, uid)
+		if err != nil {
+			t.Fatal("Error dialing room", err)
+		}
+		defer conn.Close()
+		envs := listen(conn)
+
+		await(t, envs, "state", nil)
+		conn.WriteJSON(Envelope{
+			Type: "submit",
+			Body: map[string]string{"person": "dumbledore", "place": "hogwarts", "thing": "wand"},
+		})
+		if uid == guest {
+			conn.WriteJSON(Envelope{Type: "start"})
+			await(t, envs, "start", nil)
+		}
+	}
+
+	store := NewFileStore(filepath.Join(t.TempDir(), "nouns.json"))
+	if err := SaveRooms(store); err != nil {
+		t.Fatal("Error saving rooms", err)
+	}
+
+	rooms, err := store.Load()
+	if err != nil {
+		t.Fatal("Error loading rooms", err)
+	}
+
+	var saved *RoomSnapshot
+	for i := range rooms {
+		if rooms[i].ID == room.ID {
+			saved = &rooms[i]
+		}
+	}
+	if saved == nil {
+		t.Fatal("Expected", room.ID, "got", rooms)
+	}
+
+	if len(saved.Game.Players) != 2 || saved.Game.Host != PlayerID(host) {
+		t.Error("Expected", "2 players hosted by", PlayerID(host), "got", saved.Game.Players, saved.Game.Host)
+	}
+	if !saved.Game.IsStarted || len(saved.Game.Nouns.All) != 6 {
+		t.Error("Expected", "a started game with 6 nouns", "got", saved.Game.IsStarted, len(saved.Game.Nouns.All))
+	}
+
+	// open it back up under a new code since the old room is still going
+	saved.ID = newCode()
+	if !restoreRoom(*saved) {
+		t.Fatal("Expected", "the room to be restored", "got", "a taken code")
+	}
+
+	restored, ok := GetRoom(saved.ID)
+	if !ok {
+		t.Fatal("Expected", saved.ID, "got", "nothing")
+	}
+	if !restored.Invited(host) || restored.Invited("stranger") || restored.LetIn("stranger", "secret") != nil {
+		t.Error("Expected", "the guest list and password to come back", "got", "something else")
+	}
+
+	conn, err := dialRoom(server, restored, host)
+	if err != nil {
+		t.Fatal("Error dialing room", err)
+	}
+	defer conn.Close()
+
+	// the first one back picks up presenting where the game left off
+	await(t, listen(conn), "state", func(body json.RawMessage) bool {
+		state := State{}
+		json.Unmarshal(body, &state)
+		return state.IsStarted &&
+			state.IsHost &&
+			len(state.Players) == 2 &&
+			state.Presenter != nil && state.Presenter.ID == PlayerID(host) &&
+			state.Noun != nil &&
+			state.Elapsed >= 0 && time.Duration(state.Elapsed)*time.Second < time.Minute
+	})
+}
+
+func TestFileStoreStartsEmpty(t *testing.T) {
+
+	store := NewFileStore(filepath.Join(t.TempDir(), "missing.json"))
+
+	rooms, err := store.Load()
+	if err != nil || len(rooms) != 0 {
+		t.Error("Expected", "no rooms", "got", rooms, err)
+	}
+}